@@ -0,0 +1,82 @@
+// Copyright (c) 2010, Andrei Vieru. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lzma
+
+import "unsafe"
+
+// lzHashChain is a hash chain match finder: each position links to the
+// previous one sharing its hash. It needs half the memory of a binary tree and
+// is faster, but finds fewer matches for the same depth.
+type lzHashChain struct {
+	lzMatchFinder
+}
+
+func newLzHashChain(historySize, keepAddBufBefore, matchMaxLen, keepAddBufAfter, numHashBytes, cutValue uint32) *lzHashChain {
+	hc := &lzHashChain{}
+	hc.init(historySize, keepAddBufBefore, matchMaxLen, keepAddBufAfter, numHashBytes, 1)
+	hc.cutValue = 4 + (matchMaxLen >> 2)
+	if cutValue != 0 {
+		hc.cutValue = cutValue
+	}
+	return hc
+}
+
+// lzHashChainMemUsage returns the number of bytes newLzHashChain allocates.
+func lzHashChainMemUsage(historySize, keepAddBufBefore, matchMaxLen, keepAddBufAfter, numHashBytes uint32) int64 {
+	return int64(unsafe.Sizeof(lzHashChain{})) + lzMatchFinderMemUsage(historySize, keepAddBufBefore, matchMaxLen, keepAddBufAfter, numHashBytes, 1)
+}
+
+func (hc *lzHashChain) getMatches(distances []uint32) uint32 {
+	lenLimit := hc.lenLimit()
+	if lenLimit == 0 {
+		hc.movePos()
+		return 0
+	}
+
+	matchMinPos := hc.matchMinPos()
+	cur := hc.iw.bufOffset + hc.iw.pos
+	offset, maxLen, curMatch := hc.getShortMatches(distances, cur, matchMinPos)
+	hc.son[hc.cyclicBufPos] = curMatch
+
+	for count := hc.cutValue; curMatch > matchMinPos && count != 0; count-- {
+		delta := hc.iw.pos - curMatch
+		var cyclicPos uint32
+		if delta <= hc.cyclicBufPos {
+			cyclicPos = hc.cyclicBufPos - delta
+		} else {
+			cyclicPos = hc.cyclicBufPos - delta + hc.cyclicBufSize
+		}
+		pby1 := hc.iw.bufOffset + curMatch
+		if hc.iw.buf[pby1+maxLen] == hc.iw.buf[cur+maxLen] {
+			length := uint32(0)
+			for length != lenLimit && hc.iw.buf[pby1+length] == hc.iw.buf[cur+length] {
+				length++
+			}
+			if maxLen < length {
+				maxLen = length
+				distances[offset] = maxLen
+				offset++
+				distances[offset] = delta - 1
+				offset++
+				if length == lenLimit {
+					break
+				}
+			}
+		}
+		curMatch = hc.son[cyclicPos]
+	}
+	hc.movePos()
+	return offset
+}
+
+func (hc *lzHashChain) skip(num uint32) {
+	for i := uint32(0); i < num; i++ {
+		if hc.lenLimit() != 0 {
+			cur := hc.iw.bufOffset + hc.iw.pos
+			hc.son[hc.cyclicBufPos] = hc.updateHashes(cur)
+		}
+		hc.movePos()
+	}
+}
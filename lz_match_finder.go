@@ -0,0 +1,327 @@
+// Copyright (c) 2010, Andrei Vieru. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lzma
+
+const (
+	kHash2Size          = 1 << 10
+	kHash3Size          = 1 << 16
+	kBT2HashSize        = 1 << 16
+	kStartMaxLen        = 1
+	kHash3Offset        = kHash2Size
+	kEmptyHashValue     = 0
+	kMaxValForNormalize = (1 << 30) - 1
+)
+
+// A matchFinder finds, for the byte at the current position of its window,
+// the matches with the bytes before, within the dictionary.
+type matchFinder interface {
+	// getMatches stores in distances the pairs (length, distance - 1) of
+	// the matches found, by increasing length, and returns the number of
+	// values stored. It moves to the next byte.
+	getMatches(distances []uint32) uint32
+
+	// skip moves num bytes forward, keeping track of them for the matches
+	// of the following bytes.
+	skip(num uint32)
+
+	// reset empties the match finder for a new stream.
+	reset()
+}
+
+// matchFinders maps the names of the match finders to their kind, hash chain
+// or binary tree, and to the number of bytes their main hash is made of.
+var matchFinders = map[string]struct {
+	hashChain    bool
+	numHashBytes uint32
+}{
+	"bt2": {false, 2},
+	"bt3": {false, 3},
+	"bt4": {false, 4},
+	"hc4": {true, 4},
+	"hc5": {true, 5},
+}
+
+// newMatchFinder returns the match finder called name and its window. A zero
+// cutValue selects the default depth of the match finder.
+func newMatchFinder(name string, historySize, keepAddBufBefore, matchMaxLen, keepAddBufAfter, cutValue uint32) (matchFinder, *lzInWindow) {
+	kind := matchFinders[name]
+	if kind.hashChain {
+		hc := newLzHashChain(historySize, keepAddBufBefore, matchMaxLen, keepAddBufAfter, kind.numHashBytes, cutValue)
+		return hc, hc.iw
+	}
+	bt := newLzBinTree(historySize, keepAddBufBefore, matchMaxLen, keepAddBufAfter, kind.numHashBytes, cutValue)
+	return bt, bt.iw
+}
+
+// matchFinderMemUsage returns the number of bytes newMatchFinder allocates.
+func matchFinderMemUsage(name string, historySize, keepAddBufBefore, matchMaxLen, keepAddBufAfter uint32) int64 {
+	kind := matchFinders[name]
+	if kind.hashChain {
+		return lzHashChainMemUsage(historySize, keepAddBufBefore, matchMaxLen, keepAddBufAfter, kind.numHashBytes)
+	}
+	return lzBinTreeMemUsage(historySize, keepAddBufBefore, matchMaxLen, keepAddBufAfter, kind.numHashBytes)
+}
+
+// lzMatchFinder holds what the match finders have in common: the window, the
+// hash tables and the links between the positions of the dictionary, stored
+// in son, a cyclic buffer of one (hash chain) or two (binary tree) links per
+// position.
+type lzMatchFinder struct {
+	iw                   *lzInWindow
+	son                  []uint32
+	hash                 []uint32
+	cyclicBufPos         uint32
+	cyclicBufSize        uint32
+	matchMaxLen          uint32
+	cutValue             uint32
+	hashMask             uint32
+	hashSizeSum          uint32
+	numHashBytes         uint32
+	kvNumHashDirectBytes uint32
+	kvMinMatchCheck      uint32
+	kvFixHashSize        uint32
+}
+
+// windowSizes returns the arguments of newLzInWindow for a match finder.
+func windowSizes(historySize, keepAddBufBefore, matchMaxLen, keepAddBufAfter uint32) (keepSizeBefore, keepSizeAfter, keepSizeReserv uint32) {
+	keepSizeReserv = (historySize+keepAddBufBefore+matchMaxLen+keepAddBufAfter)/2 + 256
+	return historySize + keepAddBufBefore, matchMaxLen + keepAddBufAfter, keepSizeReserv
+}
+
+// fixHashSize returns the size of the hash tables of 2 and 3 bytes used along
+// with the main hash table of numHashBytes bytes.
+func fixHashSize(numHashBytes uint32) uint32 {
+	switch numHashBytes {
+	case 2:
+		return 0
+	case 3:
+		return kHash2Size
+	}
+	return kHash2Size + kHash3Size
+}
+
+// hashSizes returns the mask of the main hash table and the total size of the
+// hash tables of a match finder hashing numHashBytes bytes.
+func hashSizes(historySize, numHashBytes uint32) (hashMask, hashSizeSum uint32) {
+	if numHashBytes == 2 {
+		return 0, kBT2HashSize
+	}
+	hs := historySize - 1
+	hs |= hs >> 1
+	hs |= hs >> 2
+	hs |= hs >> 4
+	hs |= hs >> 8
+	hs >>= 1
+	hs |= 0xFFFF
+	if hs > 1<<24 {
+		if numHashBytes == 3 {
+			hs = 1<<24 - 1
+		} else {
+			hs >>= 1
+		}
+	}
+	return hs, hs + 1 + fixHashSize(numHashBytes)
+}
+
+// lzMatchFinderMemUsage returns the number of bytes init allocates: the links,
+// the hash tables and the window.
+func lzMatchFinderMemUsage(historySize, keepAddBufBefore, matchMaxLen, keepAddBufAfter, numHashBytes, linksPerPos uint32) int64 {
+	_, hashSizeSum := hashSizes(historySize, numHashBytes)
+	mem := 4*(int64(historySize)+1)*int64(linksPerPos) + 4*int64(hashSizeSum)
+	return mem + lzInWindowMemUsage(windowSizes(historySize, keepAddBufBefore, matchMaxLen, keepAddBufAfter))
+}
+
+func (mf *lzMatchFinder) init(historySize, keepAddBufBefore, matchMaxLen, keepAddBufAfter, numHashBytes, linksPerPos uint32) {
+	mf.son = make([]uint32, (historySize+1)*linksPerPos) // history size is the dictSize from the encoder
+	mf.cyclicBufPos = 0
+	mf.cyclicBufSize = historySize + 1
+	mf.matchMaxLen = matchMaxLen
+	mf.numHashBytes = numHashBytes
+	mf.iw = newLzInWindow(windowSizes(historySize, keepAddBufBefore, matchMaxLen, keepAddBufAfter))
+
+	mf.kvFixHashSize = fixHashSize(numHashBytes)
+	mf.kvMinMatchCheck = numHashBytes
+	if numHashBytes == 2 {
+		mf.kvNumHashDirectBytes = 2
+		mf.kvMinMatchCheck = 3
+	}
+
+	mf.hashMask, mf.hashSizeSum = hashSizes(historySize, numHashBytes)
+	mf.hash = make([]uint32, mf.hashSizeSum)
+	for i := uint32(0); i < mf.hashSizeSum; i++ {
+		mf.hash[i] = kEmptyHashValue
+	}
+
+	mf.iw.reduceOffsets(0xFFFFFFFF)
+}
+
+// reset empties mf for a new stream. son does not need to be cleared: no link
+// is followed before it has been written in the current stream.
+func (mf *lzMatchFinder) reset() {
+	for i := range mf.hash {
+		mf.hash[i] = kEmptyHashValue
+	}
+	mf.cyclicBufPos = 0
+	mf.iw.reset()
+	mf.iw.reduceOffsets(0xFFFFFFFF)
+}
+
+func normalizeLinks(items []uint32, numItems, subValue uint32) {
+	for i := uint32(0); i < numItems; i++ {
+		value := items[i]
+		if value <= subValue {
+			value = kEmptyHashValue
+		} else {
+			value -= subValue
+		}
+		items[i] = value
+	}
+}
+
+func (mf *lzMatchFinder) normalize() {
+	subValue := mf.iw.pos - mf.cyclicBufSize
+	normalizeLinks(mf.son, uint32(len(mf.son)), subValue)
+	normalizeLinks(mf.hash, mf.hashSizeSum, subValue)
+	mf.iw.reduceOffsets(subValue)
+}
+
+func (mf *lzMatchFinder) movePos() {
+	mf.cyclicBufPos++
+	if mf.cyclicBufPos >= mf.cyclicBufSize {
+		mf.cyclicBufPos = 0
+	}
+	mf.iw.movePos()
+	if mf.iw.pos == kMaxValForNormalize {
+		mf.normalize()
+	}
+}
+
+// calcHashes hashes the bytes at cur: the first 2 and 3 bytes for the fixed
+// hash tables, if any, and the numHashBytes first bytes for the main one.
+// Given the first byte, the crc based hashes of 2 and 3 bytes tell the other
+// bytes apart: equal hashes mean equal bytes.
+func (mf *lzMatchFinder) calcHashes(cur uint32) (hash2Value, hash3Value, hashValue uint32) {
+	buf := mf.iw.buf
+	if mf.numHashBytes == 2 {
+		hashValue = uint32(buf[cur]) ^ uint32(buf[cur+1])<<8
+		return
+	}
+	tmp := crcTable[buf[cur]] ^ uint32(buf[cur+1])
+	hash2Value = tmp & (kHash2Size - 1)
+	tmp ^= uint32(buf[cur+2]) << 8
+	switch mf.numHashBytes {
+	case 3:
+		hashValue = tmp & mf.hashMask
+	case 4:
+		hash3Value = tmp & (kHash3Size - 1)
+		hashValue = (tmp ^ crcTable[buf[cur+3]]<<5) & mf.hashMask
+	default:
+		hash3Value = tmp & (kHash3Size - 1)
+		hashValue = (tmp ^ crcTable[buf[cur+3]]<<5 ^ crcTable[buf[cur+4]]<<10) & mf.hashMask
+	}
+	return
+}
+
+// getShortMatches records the current position, whose bytes start at cur, in
+// the hash tables. It stores in distances the matches of 2 and 3 bytes found
+// by the fixed hash tables and returns the number of values stored, the length
+// of the longest of these matches, and the candidate of the main hash table.
+func (mf *lzMatchFinder) getShortMatches(distances []uint32, cur, matchMinPos uint32) (offset, maxLen, curMatch uint32) {
+	hash2Value, hash3Value, hashValue := mf.calcHashes(cur)
+	pos := mf.iw.pos
+	buf := mf.iw.buf
+	maxLen = kStartMaxLen
+	curMatch = mf.hash[mf.kvFixHashSize+hashValue]
+	if mf.numHashBytes > 2 {
+		curMatch2 := mf.hash[hash2Value]
+		mf.hash[hash2Value] = pos
+		if curMatch2 > matchMinPos {
+			if buf[mf.iw.bufOffset+curMatch2] == buf[cur] {
+				maxLen = 2
+				distances[offset] = maxLen
+				offset++
+				distances[offset] = pos - curMatch2 - 1
+				offset++
+			}
+		}
+		if mf.numHashBytes > 3 {
+			curMatch3 := mf.hash[kHash3Offset+hash3Value]
+			mf.hash[kHash3Offset+hash3Value] = pos
+			if curMatch3 > matchMinPos {
+				if buf[mf.iw.bufOffset+curMatch3] == buf[cur] {
+					if curMatch3 == curMatch2 {
+						offset -= 2
+					}
+					maxLen = 3
+					distances[offset] = maxLen
+					offset++
+					distances[offset] = pos - curMatch3 - 1
+					offset++
+					curMatch2 = curMatch3
+				}
+			}
+		}
+		if offset != 0 && curMatch2 == curMatch {
+			offset -= 2
+			maxLen = kStartMaxLen
+		}
+	}
+	mf.hash[mf.kvFixHashSize+hashValue] = pos
+	return
+}
+
+// updateHashes records the current position, whose bytes start at cur, in the
+// hash tables and returns the candidate of the main hash table.
+func (mf *lzMatchFinder) updateHashes(cur uint32) (curMatch uint32) {
+	hash2Value, hash3Value, hashValue := mf.calcHashes(cur)
+	pos := mf.iw.pos
+	if mf.numHashBytes > 2 {
+		mf.hash[hash2Value] = pos
+	}
+	if mf.numHashBytes > 3 {
+		mf.hash[kHash3Offset+hash3Value] = pos
+	}
+	curMatch = mf.hash[mf.kvFixHashSize+hashValue]
+	mf.hash[mf.kvFixHashSize+hashValue] = pos
+	return
+}
+
+// lenLimit returns the maximum length of the matches at the current position,
+// or 0 if too few bytes are left to look for matches.
+func (mf *lzMatchFinder) lenLimit() uint32 {
+	if mf.iw.pos+mf.matchMaxLen <= mf.iw.streamPos {
+		return mf.matchMaxLen
+	}
+	lenLimit := mf.iw.streamPos - mf.iw.pos
+	if lenLimit < mf.kvMinMatchCheck {
+		return 0
+	}
+	return lenLimit
+}
+
+// matchMinPos returns the position before the oldest one in the dictionary.
+func (mf *lzMatchFinder) matchMinPos() uint32 {
+	if mf.iw.pos > mf.cyclicBufSize {
+		return mf.iw.pos - mf.cyclicBufSize
+	}
+	return 0
+}
+
+var crcTable []uint32 = make([]uint32, 256)
+
+// should be called through tablesOnce
+func initCrcTable() {
+	for i := uint32(0); i < 256; i++ {
+		r := i
+		for j := 0; j < 8; j++ {
+			if r&1 != 0 {
+				r = r>>1 ^ 0xEDB88320
+			} else {
+				r >>= 1
+			}
+		}
+		crcTable[i] = r
+	}
+}
@@ -4,71 +4,94 @@
 
 package lzma
 
-import "io"
-
+import (
+	"io"
+	"unsafe"
+)
+
+// lzOutWindow is the dictionary of the decoder. Decoded bytes stay in it until
+// they are read; once the window is full, it must be read empty before
+// decoding can go on from its start.
 type lzOutWindow struct {
-	w         io.Writer
 	buf       []byte
 	winSize   uint32
-	pos       uint32
-	streamPos uint32
-	//unpacked  uint32 // counter of unpacked bytes
+	pos       uint32 // end of the decoded bytes
+	streamPos uint32 // end of the bytes already read
 }
 
-func newLzOutWindow(w io.Writer, windowSize uint32) *lzOutWindow {
+func newLzOutWindow(windowSize uint32) *lzOutWindow {
 	return &lzOutWindow{
-		w:         w,
 		buf:       make([]byte, windowSize),
 		winSize:   windowSize,
 		pos:       0,
 		streamPos: 0,
-		//unpacked:  0,
 	}
 }
 
-func (ow *lzOutWindow) flush() {
-	size := ow.pos - ow.streamPos
-	if size == 0 {
-		return
+// lzOutWindowMemUsage returns the number of bytes newLzOutWindow allocates.
+func lzOutWindowMemUsage(windowSize uint32) int64 {
+	return int64(unsafe.Sizeof(lzOutWindow{})) + int64(windowSize)
+}
+
+func (ow *lzOutWindow) reset(windowSize uint32) {
+	ow.buf = ow.buf[:windowSize]
+	ow.winSize = windowSize
+	ow.pos = 0
+	ow.streamPos = 0
+}
+
+// preset puts in ow the last of the size bytes of dict, as many as fit, as if
+// they had been decoded and read, and returns their number.
+func (ow *lzOutWindow) preset(dict io.ReaderAt, size int64) uint32 {
+	n := ow.winSize
+	if size < int64(n) {
+		n = uint32(size)
 	}
-	n, err := ow.w.Write(ow.buf[ow.streamPos : ow.streamPos+size])
-	if err != nil {
+	if err := readTail(dict, size, ow.buf[:n]); err != nil {
 		throw(err)
 	}
-	if uint32(n) != size {
-		throw(nWriteError)
-	}
-	//unpacked += size
-	if ow.pos >= ow.winSize {
+	ow.pos = n % ow.winSize
+	ow.streamPos = ow.pos
+	return n
+}
+
+func (ow *lzOutWindow) pending() uint32 {
+	return ow.pos - ow.streamPos
+}
+
+func (ow *lzOutWindow) read(p []byte) int {
+	n := copy(p, ow.buf[ow.streamPos:ow.pos])
+	ow.streamPos += uint32(n)
+	if ow.streamPos >= ow.winSize {
 		ow.pos = 0
+		ow.streamPos = 0
 	}
-	ow.streamPos = ow.pos
+	return n
 }
 
-func (ow *lzOutWindow) copyBlock(distance, length uint32) {
+// copyBlock copies up to length bytes, stopping if the window gets full, and
+// returns the number of bytes copied.
+func (ow *lzOutWindow) copyBlock(distance, length uint32) uint32 {
 	pos := ow.pos - distance - 1
 	if pos >= ow.winSize {
 		pos += ow.winSize
 	}
-	for ; length != 0; length-- {
+	n := minUInt32(length, ow.winSize-ow.pos)
+	for i := n; i != 0; i-- {
 		if pos >= ow.winSize {
 			pos = 0
 		}
 		ow.buf[ow.pos] = ow.buf[pos]
 		ow.pos++
 		pos++
-		if ow.pos >= ow.winSize {
-			ow.flush()
-		}
 	}
+	return n
 }
 
+// putByte must not be called on a full window.
 func (ow *lzOutWindow) putByte(b byte) {
 	ow.buf[ow.pos] = b
 	ow.pos++
-	if ow.pos >= ow.winSize {
-		ow.flush()
-	}
 }
 
 func (ow *lzOutWindow) getByte(distance uint32) byte {
@@ -79,11 +102,11 @@ func (ow *lzOutWindow) getByte(distance uint32) byte {
 	return ow.buf[pos]
 }
 
+// lzInWindow buffers the input of the encoder. Data is pushed into it by write;
+// keepSizeBefore bytes before pos are kept for the match finder and up to
+// keepSizeAfter bytes after pos are read by it.
 type lzInWindow struct {
-	r              io.Reader
 	buf            []byte
-	posLimit       uint32
-	lastSafePos    uint32
 	bufOffset      uint32
 	blockSize      uint32
 	pos            uint32
@@ -93,12 +116,10 @@ type lzInWindow struct {
 	streamEnd      bool
 }
 
-func newLzInWindow(r io.Reader, keepSizeBefore, keepSizeAfter, keepSizeReserv uint32) *lzInWindow {
-	blockSize := keepSizeBefore + keepSizeAfter + keepSizeReserv
-	iw := &lzInWindow{
-		r:              r,
+func newLzInWindow(keepSizeBefore, keepSizeAfter, keepSizeReserv uint32) *lzInWindow {
+	blockSize := inBlockSize(keepSizeBefore, keepSizeAfter, keepSizeReserv)
+	return &lzInWindow{
 		buf:            make([]byte, blockSize),
-		lastSafePos:    blockSize - keepSizeAfter,
 		bufOffset:      0,
 		blockSize:      blockSize,
 		pos:            0,
@@ -107,8 +128,23 @@ func newLzInWindow(r io.Reader, keepSizeBefore, keepSizeAfter, keepSizeReserv ui
 		streamPos:      0,
 		streamEnd:      false,
 	}
-	iw.readBlock()
-	return iw
+}
+
+// inBlockSize returns the size of the buffer of an lzInWindow.
+func inBlockSize(keepSizeBefore, keepSizeAfter, keepSizeReserv uint32) uint32 {
+	return keepSizeBefore + keepSizeAfter + keepSizeReserv
+}
+
+// lzInWindowMemUsage returns the number of bytes newLzInWindow allocates.
+func lzInWindowMemUsage(keepSizeBefore, keepSizeAfter, keepSizeReserv uint32) int64 {
+	return int64(unsafe.Sizeof(lzInWindow{})) + int64(inBlockSize(keepSizeBefore, keepSizeAfter, keepSizeReserv))
+}
+
+func (iw *lzInWindow) reset() {
+	iw.bufOffset = 0
+	iw.pos = 0
+	iw.streamPos = 0
+	iw.streamEnd = false
 }
 
 func (iw *lzInWindow) moveBlock() {
@@ -117,49 +153,52 @@ func (iw *lzInWindow) moveBlock() {
 		offset--
 	}
 	numBytes := iw.bufOffset + iw.streamPos - offset
-	for i := uint32(0); i < numBytes; i++ {
-		iw.buf[i] = iw.buf[offset+i]
-	}
+	copy(iw.buf[:numBytes], iw.buf[offset:offset+numBytes])
 	iw.bufOffset -= offset
 }
 
-func (iw *lzInWindow) readBlock() {
-	if iw.streamEnd {
-		return
+// free returns the part of the buffer after the input, where the next bytes
+// go. Room is made by dropping the bytes the match finder no longer needs.
+func (iw *lzInWindow) free() []byte {
+	if iw.bufOffset+iw.streamPos == iw.blockSize && iw.bufOffset+iw.pos > iw.keepSizeBefore+1 {
+		iw.moveBlock()
 	}
-	for {
-		if iw.blockSize-iw.bufOffset-iw.streamPos == 0 {
-			return
-		}
-		n, err := iw.r.Read(iw.buf[iw.bufOffset+iw.streamPos : iw.blockSize])
-		if err != nil && err != io.EOF {
-			throw(err)
-		}
-		if n == 0 && err == io.EOF {
-			iw.posLimit = iw.streamPos
-			ptr := iw.bufOffset + iw.posLimit
-			if ptr > iw.lastSafePos {
-				iw.posLimit = iw.lastSafePos - iw.bufOffset
-			}
-			iw.streamEnd = true
-			return
-		}
-		iw.streamPos += uint32(n)
-		if iw.streamPos >= iw.pos+iw.keepSizeAfter {
-			iw.posLimit = iw.streamPos - iw.keepSizeAfter
+	return iw.buf[iw.bufOffset+iw.streamPos : iw.blockSize]
+}
+
+// write copies as much of p as fits into the window and returns the number of
+// bytes copied.
+func (iw *lzInWindow) write(p []byte) int {
+	n := copy(iw.free(), p)
+	iw.streamPos += uint32(n)
+	return n
+}
+
+// readAt reads into the window up to n bytes of r from offset off, as many as
+// fit, and returns their number. r must have them all.
+func (iw *lzInWindow) readAt(r io.ReaderAt, off, n int64) int {
+	p := iw.free()
+	if int64(len(p)) > n {
+		p = p[:n]
+	}
+	m, err := r.ReadAt(p, off)
+	if m < len(p) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
 		}
+		throw(err)
 	}
+	iw.streamPos += uint32(m)
+	return m
+}
+
+// finish tells the window that no more input will be written.
+func (iw *lzInWindow) finish() {
+	iw.streamEnd = true
 }
 
 func (iw *lzInWindow) movePos() {
 	iw.pos++
-	if iw.pos > iw.posLimit {
-		ptr := iw.bufOffset + iw.pos
-		if ptr > iw.lastSafePos {
-			iw.moveBlock()
-		}
-		iw.readBlock()
-	}
 }
 
 func (iw *lzInWindow) getIndexByte(index int32) byte {
@@ -187,7 +226,6 @@ func (iw *lzInWindow) getNumAvailableBytes() uint32 {
 
 func (iw *lzInWindow) reduceOffsets(subValue uint32) {
 	iw.bufOffset += subValue
-	iw.posLimit -= subValue
 	iw.pos -= subValue
 	iw.streamPos -= subValue
 }
@@ -28,7 +28,7 @@ var lzmaTests = []lzmaTest{
 		true,
 		"",
 		[]byte{
-			0x5d, 0x00, 0x00, 0x10, 0x00, 0x00, 0x00, 0x00,
+			0x5d, 0x00, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00,
 			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
 			0x00, 0x00,
 		},
@@ -52,7 +52,7 @@ var lzmaTests = []lzmaTest{
 		true,
 		"hello world\n",
 		[]byte{
-			0x5d, 0x00, 0x00, 0x10, 0x00, 0x0c, 0x00, 0x00,
+			0x5d, 0x00, 0x10, 0x00, 0x00, 0x0c, 0x00, 0x00,
 			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x34, 0x19,
 			0x49, 0xee, 0x8d, 0xe9, 0x17, 0x89, 0x3a, 0x33,
 			0x5f, 0xfc, 0xac, 0xf7, 0x20, 0x00,
@@ -103,7 +103,7 @@ var lzmaTests = []lzmaTest{
 			"    * Two channel types are identical if they have identical value types and\n" +
 			"the same direction.\n",
 		[]byte{
-			0x5d, 0x00, 0x00, 0x10, 0x00, 0xe8, 0x05, 0x00,
+			0x5d, 0x00, 0x10, 0x00, 0x00, 0xe8, 0x05, 0x00,
 			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x2a, 0x1d,
 			0xc9, 0xe2, 0x03, 0x0c, 0x4e, 0x75, 0xc8, 0xee,
 			0x65, 0x97, 0xae, 0x0a, 0x7b, 0x0a, 0x66, 0xfa,
@@ -284,7 +284,7 @@ var lzmaTests = []lzmaTest{
 			0x49, 0xee, 0x8d, 0xe9, 0x17, 0x89, 0x3a, 0x33,
 			0x5f, 0xfc, 0xac, 0xf7, 0x20, 0x00,
 		},
-		headerError,
+		ErrHeader,
 	},
 }
 
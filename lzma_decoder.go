@@ -50,8 +50,11 @@
 package lzma
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"unsafe"
 )
 
 const (
@@ -88,28 +91,88 @@ const (
 	kMatchMaxLen                    = kMatchMinLen + kNumLenSymbols - 1
 )
 
-// A streamError reports the presence of corrupt input stream.
-var streamError = errors.New("error in lzma encoded data stream")
+var (
+	// ErrCorrupt reports corrupt compressed data. Every *CorruptError
+	// matches it, whatever its Err.
+	ErrCorrupt = errors.New("lzma: corrupt data")
 
-// A headerError reports an error in the header of the lzma encoder file.
-var headerError = errors.New("error in lzma header")
+	// ErrHeader reports an invalid .lzma header.
+	ErrHeader = errors.New("lzma: invalid header")
 
-// A nWriteError reports what its message reads
-var nWriteError = errors.New("number of bytes returned by Writer.Write() didn't meet expectances")
+	// ErrUnexpectedEOF reports a stream truncated before its end. For
+	// compatibility, a *CorruptError holding it also matches
+	// io.ErrUnexpectedEOF.
+	ErrUnexpectedEOF = errors.New("lzma: unexpected end of stream")
 
-// TODO: implement this err
-// A dataIntegrityError reports an error encountered while cheching data integrity.
-// -- from lzma.txt:
-// You can use multiple checks to test data integrity after full decompression:
-// 1) Check Result and "status" variable.
-// 2) Check that output(destLen) = uncompressedSize, if you know real uncompressedSize.
-// 3) Check that output(srcLen) = compressedSize, if you know real compressedSize.
-//     You must use correct finish mode in that case.
-//
-//type dataIntegrityError struct {
-//	msg string
-//	// hz
-//}
+	// ErrInvalidOption reports an out of range level, size, property or
+	// other setting passed by the caller.
+	ErrInvalidOption = errors.New("lzma: invalid option")
+)
+
+// A CorruptError reports where decoding of a corrupt, truncated or otherwise
+// invalid stream failed. Errors of the underlying io.Reader are returned
+// as is, not as a CorruptError.
+type CorruptError struct {
+	Offset int64 // number of compressed bytes read, header included
+	Pos    int64 // number of bytes decoded
+	Err    error // ErrCorrupt, ErrHeader, ErrUnexpectedEOF or a strict check error
+}
+
+func (e *CorruptError) Error() string {
+	return fmt.Sprintf("%v at offset %d, position %d", e.Err, e.Offset, e.Pos)
+}
+
+// Unwrap returns e.Err.
+func (e *CorruptError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrCorrupt, or io.ErrUnexpectedEOF for a
+// truncated stream; other targets are matched against e.Err by errors.Is.
+func (e *CorruptError) Is(target error) bool {
+	return target == ErrCorrupt || target == io.ErrUnexpectedEOF && e.Err == ErrUnexpectedEOF
+}
+
+// ErrClosed is returned by a Read or a Write after Close.
+var ErrClosed = errors.New("use of closed lzma stream")
+
+// ErrMemLimit is returned by a Reader when decoding the stream would need more
+// memory than allowed by its ReaderConfig. Nothing is allocated for the stream.
+var ErrMemLimit = errors.New("lzma: memory limit exceeded")
+
+// ErrOutputLimit is returned by a Reader when the stream decodes to more bytes
+// than allowed by its ReaderConfig. The bytes up to the limit are returned
+// before the error.
+var ErrOutputLimit = errors.New("lzma: output limit exceeded")
+
+// The following errors are returned by a strict Reader, see ReaderConfig, for
+// streams failing the integrity checks done at their end.
+var (
+	// ErrBadFirstByte reports a range coder whose first byte is not zero.
+	ErrBadFirstByte = errors.New("lzma: first byte of the range coder is not zero")
+
+	// ErrEarlyEndMarker reports an end marker before the declared size.
+	ErrEarlyEndMarker = errors.New("lzma: end marker before the declared size")
+
+	// ErrBadFinalCode reports a range coder not finished at the end of the
+	// stream.
+	ErrBadFinalCode = errors.New("lzma: range coder not finished at end of stream")
+
+	// ErrTrailingData reports bytes following the end of the stream.
+	ErrTrailingData = errors.New("lzma: trailing data after end of stream")
+
+	// ErrMissingEndMarker reports a stream of known size without the end
+	// marker required by MarkerRequired.
+	ErrMissingEndMarker = errors.New("lzma: no end marker at the declared size")
+
+	// ErrForbiddenEndMarker reports a stream of known size with an end
+	// marker, forbidden by MarkerForbidden.
+	ErrForbiddenEndMarker = errors.New("lzma: end marker at the declared size")
+
+	// ErrMatchOverrun reports a match running past the declared size. A
+	// lenient Reader cuts it at the declared size.
+	ErrMatchOverrun = errors.New("lzma: match past the declared size")
+)
 
 func stateUpdateChar(index uint32) uint32 {
 	if index < 4 {
@@ -164,28 +227,146 @@ func getLenToPosState(length uint32) uint32 {
 //   1     4   		Dictionary size (little endian)
 //   5     8   		Uncompressed size (little endian). Size -1 stands for unknown size
 
-// lzma properties
-type props struct {
-	litContextBits, // lc
-	litPosStateBits, // lp
-	posStateBits uint8 // pb
-	dictSize uint32
+// Props holds the lzma properties: the number of literal context bits (lc),
+// the number of literal position bits (lp), the number of position bits (pb)
+// and the dictionary size. In the .lzma file format they are stored in the
+// first 5 bytes of the header; other containers, like zip, store them on their
+// own and omit the rest of the header.
+type Props struct {
+	LC, LP, PB uint8
+	DictSize   uint32
 }
 
-func (p *props) decodeProps(buf []byte) {
+func (p *Props) decodeProps(buf []byte) error {
 	d := buf[0]
 	if d > (9 * 5 * 5) {
-		throw(headerError)
+		return ErrHeader
 	}
-	p.litContextBits = d % 9
+	p.LC = d % 9
 	d /= 9
-	p.posStateBits = d / 5
-	p.litPosStateBits = d % 5
-	if p.litContextBits > kNumLitContextBitsMax || p.litPosStateBits > 4 || p.posStateBits > kNumPosStatesBitsMax {
-		throw(headerError)
+	p.PB = d / 5
+	p.LP = d % 5
+	if p.LC > kNumLitContextBitsMax || p.LP > 4 || p.PB > kNumPosStatesBitsMax {
+		return ErrHeader
 	}
+	p.DictSize = 0
 	for i := 0; i < 4; i++ {
-		p.dictSize += uint32(buf[i+1]) << uint32(i*8)
+		p.DictSize += uint32(buf[i+1]) << uint32(i*8)
+	}
+	return nil
+}
+
+func (p *Props) encodeProps(buf []byte) {
+	buf[0] = byte((p.PB*5+p.LP)*9 + p.LC)
+	for i := uint32(0); i < 4; i++ {
+		buf[i+1] = byte(p.DictSize >> (8 * i))
+	}
+}
+
+func (p *Props) validate() error {
+	if p.LC > kNumLitContextBitsMax {
+		return &argumentValueError{"number of literal context bits out of range", p.LC}
+	}
+	if p.LP > 4 {
+		return &argumentValueError{"number of literal position bits out of range", p.LP}
+	}
+	if p.PB > kNumPosStatesBitsMax {
+		return &argumentValueError{"number of position bits out of range", p.PB}
+	}
+	return nil
+}
+
+// MarshalBinary encodes p in the 5 bytes used by the .lzma header.
+func (p *Props) MarshalBinary() ([]byte, error) {
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, lzmaPropSize)
+	p.encodeProps(buf)
+	return buf, nil
+}
+
+// UnmarshalBinary decodes the 5 bytes of properties found at the start of b,
+// as done by the decoder. It fails with ErrUnexpectedEOF if b is too short,
+// or with ErrHeader if the properties are out of range.
+func (p *Props) UnmarshalBinary(b []byte) error {
+	if len(b) < lzmaPropSize {
+		return ErrUnexpectedEOF
+	}
+	return p.decodeProps(b)
+}
+
+// A Header is the 13 byte header of the .lzma file format: the properties of
+// the stream followed by its uncompressed size, which may be unknown. Streams
+// of unknown size are terminated by an end marker.
+type Header struct {
+	Props
+	UncompressedSize int64 // meaningful only if SizeKnown
+	SizeKnown        bool
+}
+
+// ReadHeader reads the header of an .lzma file from r, leaving r at the start
+// of the compressed data.
+func ReadHeader(r io.Reader) (h Header, err error) {
+	var buf [lzmaHeaderSize]byte
+	if _, err = io.ReadFull(r, buf[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = ErrUnexpectedEOF
+		}
+		return
+	}
+	err = h.UnmarshalBinary(buf[:])
+	return
+}
+
+// ParseHeader parses the header at the start of b, which must hold at least
+// 13 bytes.
+func ParseHeader(b []byte) (h Header, err error) {
+	err = h.UnmarshalBinary(b)
+	return
+}
+
+// MarshalBinary encodes h in the 13 bytes of the .lzma header.
+func (h *Header) MarshalBinary() ([]byte, error) {
+	if err := h.validate(); err != nil {
+		return nil, err
+	}
+	if h.SizeKnown && h.UncompressedSize < 0 {
+		return nil, &argumentValueError{"illegal size", h.UncompressedSize}
+	}
+	buf := make([]byte, lzmaHeaderSize)
+	h.encode(buf)
+	return buf, nil
+}
+
+// UnmarshalBinary decodes the header at the start of b, with the checks done
+// by the decoder. A negative size stands for an unknown size.
+func (h *Header) UnmarshalBinary(b []byte) error {
+	if len(b) < lzmaHeaderSize {
+		return ErrUnexpectedEOF
+	}
+	if err := h.decodeProps(b); err != nil {
+		return err
+	}
+	h.UncompressedSize = 0
+	for i := 0; i < 8; i++ {
+		h.UncompressedSize |= int64(b[lzmaPropSize+i]) << uint(8*i)
+	}
+	h.SizeKnown = h.UncompressedSize >= 0
+	if !h.SizeKnown {
+		h.UncompressedSize = -1
+	}
+	return nil
+}
+
+func (h *Header) encode(buf []byte) {
+	h.encodeProps(buf)
+	size := h.UncompressedSize
+	if !h.SizeKnown {
+		size = -1
+	}
+	for i := uint(0); i < 8; i++ {
+		buf[lzmaPropSize+i] = byte(size >> (8 * i))
 	}
 }
 
@@ -195,8 +376,18 @@ type decoder struct {
 	outWin *lzOutWindow  // w
 
 	// lzma header
-	prop       *props
+	header     [lzmaHeaderSize]byte
+	headerLen  int64 // number of header bytes read, 0 for raw streams
+	prop       Props
 	unpackSize int64
+	eos        bool // an end marker is expected; always true if unpackSize is -1
+
+	maxOutput    int64        // -1 if unlimited
+	strict       bool         // verifyEnd is called at the end of the stream
+	markerPolicy MarkerPolicy // end marker at the declared size, if strict
+	preset       io.ReaderAt  // preset dictionary or patch reference
+	presetSize   int64        // size of preset
+	presetLen    uint64       // number of bytes of preset in the window
 
 	// hz
 	matchDecoders    []uint16
@@ -213,21 +404,51 @@ type decoder struct {
 	litCoder         *litCoder
 	dictSizeCheck    uint32
 	posStateMask     uint32
+
+	// decoding state, kept between calls to doDecode
+	state                  uint32
+	rep0, rep1, rep2, rep3 uint32
+	nowPos                 uint64
+	prevByte               byte
+	remLen                 uint32 // length of the match still to be copied
+	finished               bool
 }
 
-func (z *decoder) doDecode() {
-	var state uint32 = 0
-	var rep0 uint32 = 0
-	var rep1 uint32 = 0
-	var rep2 uint32 = 0
-	var rep3 uint32 = 0
-	var nowPos uint64 = 0
-	var prevByte byte = 0
+// doDecode decodes until at least limit bytes are waiting to be read from the
+// output window, the window is full or the end of the stream is reached.
+func (z *decoder) doDecode(limit uint32) {
+	if z.remLen != 0 {
+		z.copyMatch(z.remLen)
+	}
+
+	state := z.state
+	rep0, rep1, rep2, rep3 := z.rep0, z.rep1, z.rep2, z.rep3
+	nowPos := z.nowPos
+	prevByte := z.prevByte
+	marker := false
+	defer func() {
+		// for the position of an error thrown while decoding
+		if z.nowPos < nowPos {
+			z.nowPos = nowPos
+		}
+	}()
 
-	for z.unpackSize < 0 || int64(nowPos) < z.unpackSize {
+	for z.remLen == 0 && z.outWin.pos < z.outWin.winSize && z.outWin.pending() < limit {
+		if z.unpackSize >= 0 && int64(nowPos) >= z.unpackSize {
+			z.finished = true
+			break
+		}
+		// without a size and an end marker, the stream ends with its input
+		if z.unpackSize < 0 && !z.eos && z.rd.atEOF() {
+			z.finished = true
+			break
+		}
 		posState := uint32(nowPos) & z.posStateMask
 		if z.rd.decodeBit(z.matchDecoders, state<<kNumPosStatesBitsMax+posState) == 0 {
 			lsc := z.litCoder.getSubCoder(uint32(nowPos), prevByte)
+			if z.maxOutput >= 0 && int64(nowPos) >= z.maxOutput {
+				throw(ErrOutputLimit)
+			}
 			if !stateIsCharState(state) {
 				prevByte = lsc.decodeWithMatchByte(z.rd, z.outWin.getByte(rep0))
 			} else {
@@ -278,86 +499,490 @@ func (z *decoder) doDecode() {
 						rep0 += z.posAlignCoder.reverseDecode(z.rd)
 						if int32(rep0) < 0 {
 							if rep0 == 0xFFFFFFFF {
+								z.finished = true
+								marker = true
 								break
 							}
-							throw(streamError)
+							throw(ErrCorrupt)
 						}
 					}
 				} else {
 					rep0 = posSlot
 				}
 			}
-			if uint64(rep0) >= nowPos || rep0 >= z.dictSizeCheck {
-				throw(streamError)
+			if uint64(rep0) >= nowPos+z.presetLen || rep0 >= z.dictSizeCheck {
+				throw(ErrCorrupt)
 			}
-			z.outWin.copyBlock(rep0, length)
-			nowPos += uint64(length)
-			prevByte = z.outWin.getByte(0)
+			z.rep0 = rep0
+			z.nowPos = nowPos
+			z.copyMatch(length)
+			nowPos = z.nowPos
+			prevByte = z.prevByte
 		}
 	}
-	z.outWin.flush()
-	//if z.unpackSize != -1 {
-	//	if z.outWin.unpacked != z.unpackSize {
-	//		throw(&dataIntegrityError{})
-	//	}
-	//}
+
+	z.state = state
+	z.rep0, z.rep1, z.rep2, z.rep3 = rep0, rep1, rep2, rep3
+	z.nowPos = nowPos
+	z.prevByte = prevByte
+	if z.finished && z.strict {
+		z.verifyEnd(marker)
+	}
 }
 
-func (z *decoder) decoder(r io.Reader, w io.Writer) (err error) {
-	defer handlePanics(&err)
+// verifyEnd checks that the stream, having just ended with or without an end
+// marker, is intact, as described in lzma.txt. A stream of known size may
+// still have its end marker after the last byte.
+func (z *decoder) verifyEnd(marker bool) {
+	if z.unpackSize >= 0 {
+		if marker && int64(z.nowPos) < z.unpackSize {
+			throw(ErrEarlyEndMarker)
+		}
+		if !marker && !z.rd.atEOF() {
+			if !z.readEndMarker() {
+				throw(ErrTrailingData)
+			}
+			marker = true
+		}
+		if marker && z.markerPolicy == MarkerForbidden {
+			throw(ErrForbiddenEndMarker)
+		}
+		if !marker && z.markerPolicy == MarkerRequired {
+			throw(ErrMissingEndMarker)
+		}
+	}
+	if z.rd.code != 0 {
+		throw(ErrBadFinalCode)
+	}
+	if !z.rd.atEOF() {
+		throw(ErrTrailingData)
+	}
+}
 
+// readEndMarker decodes the next symbol and reports whether it is an end
+// marker; it mirrors encoder.writeEndMarker.
+func (z *decoder) readEndMarker() bool {
+	posState := uint32(z.nowPos) & z.posStateMask
+	if z.rd.decodeBit(z.matchDecoders, z.state<<kNumPosStatesBitsMax+posState) == 0 {
+		return false
+	}
+	if z.rd.decodeBit(z.repDecoders, z.state) == 1 {
+		return false
+	}
+	length := z.lenCoder.decode(z.rd, posState) + kMatchMinLen
+	posSlot := z.posSlotCoders[getLenToPosState(length)].decode(z.rd)
+	if posSlot != 1<<kNumPosSlotBits-1 {
+		return false
+	}
+	footerBits := uint32(30)
+	posReduced := z.rd.decodeDirectBits(footerBits-kNumAlignBits) << kNumAlignBits
+	posReduced += z.posAlignCoder.reverseDecode(z.rd)
+	return posReduced == 1<<footerBits-1
+}
+
+// copyMatch copies length bytes from distance z.rep0, as many as fit in the
+// output window; the rest is left in z.remLen for the next call. Reaching
+// z.maxOutput with bytes left fails with ErrOutputLimit. A match running past
+// the declared size fails with ErrMatchOverrun if strict, and is cut otherwise.
+func (z *decoder) copyMatch(length uint32) {
+	if z.unpackSize >= 0 && uint64(length) > uint64(z.unpackSize)-z.nowPos {
+		if z.strict {
+			throw(ErrMatchOverrun)
+		}
+		length = uint32(uint64(z.unpackSize) - z.nowPos)
+	}
+	n := length
+	if z.maxOutput >= 0 && uint64(n) > uint64(z.maxOutput)-z.nowPos {
+		n = uint32(uint64(z.maxOutput) - z.nowPos)
+	}
+	n = z.outWin.copyBlock(z.rep0, n)
+	z.remLen = length - n
+	z.nowPos += uint64(n)
+	if z.remLen != 0 && int64(z.nowPos) == z.maxOutput {
+		throw(ErrOutputLimit)
+	}
+	z.prevByte = z.outWin.getByte(0)
+}
+
+func (z *decoder) readHeader(r io.Reader) {
 	// read 13 bytes (lzma header)
-	header := make([]byte, lzmaHeaderSize)
-	_, err = io.ReadFull(r, header)
+	header := z.header[:]
+	n, err := io.ReadFull(r, header)
+	z.headerLen += int64(n)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = ErrUnexpectedEOF
+	}
 	if err != nil {
-		return
+		throw(err)
+	}
+	var h Header
+	if err = h.UnmarshalBinary(header); err != nil {
+		throw(err)
 	}
-	z.prop = &props{}
-	z.prop.decodeProps(header)
+	z.prop = h.Props
+	z.unpackSize = h.UncompressedSize
+	z.eos = !h.SizeKnown
+}
 
-	z.unpackSize = 0
-	for i := 0; i < 8; i++ {
-		b := header[lzmaPropSize+i]
-		z.unpackSize = z.unpackSize | int64(b)<<uint64(8*i)
-	}
-
-	// do not move before r.Read(header)
-	z.rd = newRangeDecoder(r)
-
-	z.dictSizeCheck = maxUInt32(z.prop.dictSize, 1)
-	z.outWin = newLzOutWindow(w, maxUInt32(z.dictSizeCheck, 1<<12))
-
-	z.litCoder = newLitCoder(uint32(z.prop.litPosStateBits), uint32(z.prop.litContextBits))
-	z.lenCoder = newLenCoder(uint32(1 << z.prop.posStateBits))
-	z.repLenCoder = newLenCoder(uint32(1 << z.prop.posStateBits))
-	z.posStateMask = uint32(1<<z.prop.posStateBits - 1)
-	z.matchDecoders = initBitModels(kNumStates << kNumPosStatesBitsMax)
-	z.repDecoders = initBitModels(kNumStates)
-	z.repG0Decoders = initBitModels(kNumStates)
-	z.repG1Decoders = initBitModels(kNumStates)
-	z.repG2Decoders = initBitModels(kNumStates)
-	z.rep0LongDecoders = initBitModels(kNumStates << kNumPosStatesBitsMax)
-	z.posDecoders = initBitModels(kNumFullDistances - kEndPosModelIndex)
-	z.posSlotCoders = make([]*rangeBitTreeCoder, kNumLenToPosStates)
-	for i := 0; i < kNumLenToPosStates; i++ {
-		z.posSlotCoders[i] = newRangeBitTreeCoder(kNumPosSlotBits)
-	}
-	z.posAlignCoder = newRangeBitTreeCoder(kNumAlignBits)
-
-	z.doDecode()
+// wrapError turns *err into a *CorruptError if it reports an invalid stream.
+// It is deferred after handlePanics.
+func (z *decoder) wrapError(err *error) {
+	switch *err {
+	case ErrCorrupt, ErrHeader, ErrUnexpectedEOF,
+		ErrBadFirstByte, ErrEarlyEndMarker, ErrBadFinalCode, ErrTrailingData,
+		ErrMissingEndMarker, ErrForbiddenEndMarker, ErrMatchOverrun:
+		offset := z.headerLen
+		if z.rd != nil {
+			offset += z.rd.n
+		}
+		*err = &CorruptError{Offset: offset, Pos: int64(z.nowPos), Err: *err}
+	}
+}
+
+// DecoderMemoryUsage returns the number of bytes a Reader allocates to decode
+// a stream with the header h, of which the window, the size of the dictionary
+// unless the stream is smaller, takes the most. This counts the Reader itself
+// and its 4 KiB input buffer, which a Reader from an io.ByteReader does
+// without; the allocator rounds each allocation up a little more. With a
+// preset dictionary or a patch reference, which is not copied, the window must
+// hold it too: add its size to h.UncompressedSize if h.SizeKnown.
+//
+func DecoderMemoryUsage(h Header) int64 {
+	size := int64(-1)
+	if h.SizeKnown {
+		size = h.UncompressedSize
+	}
+	return decoderMemUsage(&h.Props, size)
+}
+
+// decoderMemUsage returns the number of bytes a Reader allocates to decode a
+// stream of size bytes, -1 if unknown, with the properties p: the Reader
+// itself, with the decoder, and what init allocates.
+func decoderMemUsage(p *Props, size int64) int64 {
+	mem := int64(unsafe.Sizeof(Reader{})) + rangeDecoderMemUsage()
+	mem += lzOutWindowMemUsage(windowSize(p, size))
+	mem += litCoderMemUsage(uint32(p.LP), uint32(p.LC))
+	mem += 2 * lenCoderMemUsage(uint32(1)<<p.PB)
+	return mem + modelsMemUsage()
+}
+
+// windowSize returns the size of the window needed to decode a stream of size
+// bytes, -1 if unknown, with the properties p: the dictionary size, unless the
+// whole stream is smaller.
+func windowSize(p *Props, size int64) uint32 {
+	winSize := maxUInt32(p.DictSize, 1)
+	if size >= 0 && size < int64(winSize) {
+		winSize = uint32(size)
+	}
+	return maxUInt32(winSize, 1<<12)
+}
+
+// modelsMemUsage returns the number of bytes of the probability models the
+// encoder and the decoder allocate besides those of the literal and length
+// coders.
+func modelsMemUsage() int64 {
+	mem := 2*bitModelsMemUsage(kNumStates<<kNumPosStatesBitsMax) + 4*bitModelsMemUsage(kNumStates)
+	mem += bitModelsMemUsage(kNumFullDistances - kEndPosModelIndex)
+	mem += kNumLenToPosStates * (int64(unsafe.Sizeof(&rangeBitTreeCoder{})) + rangeBitTreeCoderMemUsage(kNumPosSlotBits))
+	return mem + rangeBitTreeCoderMemUsage(kNumAlignBits)
+}
+
+// init makes z ready to decode the stream read from r, whose properties are
+// in z.prop. Whatever was allocated for a previous stream is reused if it fits.
+func (z *decoder) init(r io.Reader) {
+	if z.rd == nil {
+		z.rd = newRangeDecoder(r)
+	} else {
+		z.rd.init(r)
+	}
+	if z.strict && z.rd.first != 0 {
+		throw(ErrBadFirstByte)
+	}
+
+	z.dictSizeCheck = maxUInt32(z.prop.DictSize, 1)
+	winSize := windowSize(&z.prop, z.span())
+	if z.outWin == nil || uint32(cap(z.outWin.buf)) < winSize {
+		z.outWin = newLzOutWindow(winSize)
+	} else {
+		z.outWin.reset(winSize)
+	}
+
+	numPosStates := uint32(1 << z.prop.PB)
+	if z.litCoder == nil {
+		z.litCoder = newLitCoder(uint32(z.prop.LP), uint32(z.prop.LC))
+		z.lenCoder = newLenCoder(numPosStates)
+		z.repLenCoder = newLenCoder(numPosStates)
+		z.posSlotCoders = make([]*rangeBitTreeCoder, kNumLenToPosStates)
+		for i := 0; i < kNumLenToPosStates; i++ {
+			z.posSlotCoders[i] = newRangeBitTreeCoder(kNumPosSlotBits)
+		}
+		z.posAlignCoder = newRangeBitTreeCoder(kNumAlignBits)
+	} else {
+		z.litCoder.reset(uint32(z.prop.LP), uint32(z.prop.LC))
+		z.lenCoder.reset(numPosStates)
+		z.repLenCoder.reset(numPosStates)
+		for i := 0; i < kNumLenToPosStates; i++ {
+			z.posSlotCoders[i].reset()
+		}
+		z.posAlignCoder.reset()
+	}
+	z.posStateMask = numPosStates - 1
+	z.matchDecoders = reuseBitModels(z.matchDecoders, kNumStates<<kNumPosStatesBitsMax)
+	z.repDecoders = reuseBitModels(z.repDecoders, kNumStates)
+	z.repG0Decoders = reuseBitModels(z.repG0Decoders, kNumStates)
+	z.repG1Decoders = reuseBitModels(z.repG1Decoders, kNumStates)
+	z.repG2Decoders = reuseBitModels(z.repG2Decoders, kNumStates)
+	z.rep0LongDecoders = reuseBitModels(z.rep0LongDecoders, kNumStates<<kNumPosStatesBitsMax)
+	z.posDecoders = reuseBitModels(z.posDecoders, kNumFullDistances-kEndPosModelIndex)
+
+	z.state = 0
+	z.rep0, z.rep1, z.rep2, z.rep3 = 0, 0, 0, 0
+	z.nowPos = 0
+	z.prevByte = 0
+	z.remLen = 0
+	z.finished = false
+
+	z.presetLen = 0
+	if z.presetSize > 0 {
+		z.presetLen = uint64(z.outWin.preset(z.preset, z.presetSize))
+		z.prevByte = z.outWin.getByte(0)
+	}
+}
+
+// span returns the number of bytes the window may have to hold: those of the
+// preset dictionary and of the stream, -1 if unknown.
+func (z *decoder) span() int64 {
+	if z.unpackSize < 0 {
+		return -1
+	}
+	return z.presetSize + z.unpackSize
+}
+
+// A Reader is an io.ReadCloser reading the uncompressed version of an lzma
+// stream. Decoding happens inside Read, in the caller's goroutine, and goes
+// no further than needed to fill the buffer passed to Read.
+//
+type Reader struct {
+	r         io.Reader
+	z         decoder
+	raw       bool  // the stream has no header, the following fields replace it
+	props     Props // properties of a raw stream
+	size      int64 // size of a raw stream
+	eos       bool  // a raw stream has an end marker
+	cfg       ReaderConfig
+	ref       io.ReaderAt  // reference of a patch, see NewReaderPatch
+	refHeader PatchHeader  // patch header expected with ref
+	dict      bytes.Reader // reader of cfg.Dict
+	hasHeader bool         // the header is read, or replaced by the raw settings
+	started   bool
+	closed    bool
+	err       error
+}
+
+// Read reads up to len(p) uncompressed bytes into p.
+func (zr *Reader) Read(p []byte) (n int, err error) {
+	if zr.closed {
+		return 0, ErrClosed
+	}
+	for {
+		if zr.started && zr.z.outWin.pending() > 0 {
+			n = zr.z.outWin.read(p)
+			return
+		}
+		if zr.err != nil || len(p) == 0 {
+			return 0, zr.err
+		}
+		limit := uint32(1<<31 - 1)
+		if len(p) < int(limit) {
+			limit = uint32(len(p))
+		}
+		zr.err = zr.decode(limit)
+	}
+}
+
+func (zr *Reader) decode(limit uint32) (err error) {
+	defer zr.z.wrapError(&err)
+	defer handlePanics(&err)
+
+	if !zr.started {
+		// where errors are reported until init is done
+		zr.z.headerLen, zr.z.nowPos = 0, 0
+		if zr.z.rd != nil {
+			zr.z.rd.n = 0
+		}
+		if zr.raw {
+			zr.z.prop = zr.props
+			zr.z.unpackSize = zr.size
+			zr.z.eos = zr.eos
+		} else {
+			if zr.ref != nil {
+				zr.readPatchHeader()
+			}
+			zr.z.readHeader(zr.r)
+		}
+		zr.hasHeader = true
+		zr.z.preset, zr.z.presetSize = nil, 0
+		if zr.ref != nil {
+			zr.z.preset, zr.z.presetSize = zr.ref, zr.refHeader.RefSize
+		} else if len(zr.cfg.Dict) > 0 {
+			zr.dict.Reset(zr.cfg.Dict)
+			zr.z.preset, zr.z.presetSize = &zr.dict, int64(len(zr.cfg.Dict))
+		}
+		if zr.cfg.MemLimit > 0 && decoderMemUsage(&zr.z.prop, zr.z.span()) > zr.cfg.MemLimit {
+			throw(ErrMemLimit)
+		}
+		zr.z.strict = !zr.cfg.Lenient
+		zr.z.markerPolicy = zr.cfg.EndMarker
+		zr.z.maxOutput = -1
+		if zr.cfg.MaxOutput > 0 {
+			zr.z.maxOutput = zr.cfg.MaxOutput
+			if zr.z.unpackSize > zr.z.maxOutput {
+				throw(ErrOutputLimit)
+			}
+		}
+		// do not move before readHeader
+		zr.z.init(zr.r)
+		zr.started = true
+	}
+	if zr.z.finished {
+		return io.EOF
+	}
+	zr.z.doDecode(limit)
 	return
 }
 
+// Header returns the header of the stream, once read by the first call to
+// Read; ok is false before. The header is available even if the stream is then
+// rejected for the limits of the ReaderConfig. For a raw stream, it holds the
+// properties and the size the Reader was created with.
+func (zr *Reader) Header() (h Header, ok bool) {
+	if !zr.hasHeader {
+		return
+	}
+	h.Props = zr.z.prop
+	h.UncompressedSize = zr.z.unpackSize
+	h.SizeKnown = zr.z.unpackSize >= 0
+	return h, true
+}
+
+// Close closes the Reader; it does not close the underlying io.Reader.
+func (zr *Reader) Close() error {
+	zr.closed = true
+	return nil
+}
+
+// Reset discards the Reader's state and makes it equivalent to the result of
+// its original constructor, but reading from r instead. A raw Reader keeps the
+// properties, size and end marker setting it was created with.
+//
+// Reset reuses the dictionary and the probability tables of the previous
+// stream when they are large enough for the new one, so that a Reader kept
+// for many similar streams does not allocate once warmed up.
+func (zr *Reader) Reset(r io.Reader) {
+	zr.r = r
+	zr.hasHeader = false
+	zr.started = false
+	zr.closed = false
+	zr.err = nil
+	if zr.raw {
+		zr.err = zr.props.validate()
+	}
+}
+
+// A ReaderConfig holds the settings of a Reader. The zero value is the
+// configuration of NewReader.
+type ReaderConfig struct {
+	// MemLimit is the maximum number of bytes the Reader may allocate for
+	// decoding, as given by DecoderMemoryUsage with the window holding Dict
+	// or the patch reference too. A stream needing more is rejected with
+	// ErrMemLimit once its header is read, before the window and the tables
+	// are allocated for it. If zero, there is no limit.
+	MemLimit int64
+
+	// MaxOutput is the maximum number of bytes the Reader may decode. A
+	// stream declaring a larger size is rejected with ErrOutputLimit before
+	// anything is decoded; a stream of unknown size fails with ErrOutputLimit
+	// as soon as it would go past the limit. If zero, there is no limit.
+	MaxOutput int64
+
+	// Lenient turns off the integrity checks done at the end of the stream,
+	// reported by ErrBadFirstByte, ErrEarlyEndMarker, ErrBadFinalCode,
+	// ErrTrailingData, ErrMatchOverrun and the errors of EndMarker. A lenient
+	// Reader stops at the declared size without looking at what follows, cuts
+	// a match running past it, and accepts an end marker before it.
+	Lenient bool
+
+	// EndMarker tells whether a stream of known size may, must or must not
+	// end with an end marker, after the declared size; a stream of unknown
+	// size needs one anyway. A lenient Reader does not check it.
+	EndMarker MarkerPolicy
+
+	// Dict is the preset dictionary the stream was compressed with, see
+	// NewWriterDict. Decoding starts with it in the window, without it being
+	// returned. It must not be modified while the Reader is in use.
+	Dict []byte
+}
+
+// NewReaderDict is like NewReader, but the stream is decoded with the preset
+// dictionary dict, which must be the one given to NewWriterDict.
+//
+func NewReaderDict(r io.Reader, dict []byte) io.ReadCloser {
+	return NewReaderConfig(r, ReaderConfig{Dict: dict})
+}
+
+// A MarkerPolicy tells whether a stream of known size may end with an end
+// marker, as allowed by the .lzma format and by zip (flag bit 1).
+type MarkerPolicy int
+
+const (
+	// MarkerAllowed accepts streams with or without an end marker.
+	MarkerAllowed MarkerPolicy = iota
+
+	// MarkerRequired fails streams without an end marker with
+	// ErrMissingEndMarker.
+	MarkerRequired
+
+	// MarkerForbidden fails streams with an end marker with
+	// ErrForbiddenEndMarker.
+	MarkerForbidden
+)
+
+// NewReaderConfig is like NewReader, but the Reader is configured by c.
+//
+func NewReaderConfig(r io.Reader, c ReaderConfig) *Reader {
+	return &Reader{r: r, cfg: c}
+}
+
+// NewReaderRawConfig is like NewReaderRaw, but the Reader is configured by c.
+//
+func NewReaderRawConfig(r io.Reader, p Props, size int64, eos bool, c ReaderConfig) *Reader {
+	zr := NewReaderRaw(r, p, size, eos).(*Reader)
+	zr.cfg = c
+	return zr
+}
+
 // NewReader returns a new ReadCloser that can be used to read the uncompressed
 // version of r. It is the caller's responsibility to call Close on the ReadCloser
-// when finished reading.
+// when finished reading. The ReadCloser is a *Reader.
 //
 func NewReader(r io.Reader) io.ReadCloser {
-	var z decoder
-	pr, pw := io.Pipe()
-	go func() {
-		err := z.decoder(r, pw)
-		pw.CloseWithError(err)
-	}()
-	return pr
+	return &Reader{r: r}
+}
+
+// NewReaderRaw returns a new ReadCloser that can be used to read the
+// uncompressed version of r, a raw lzma stream with no header, like the ones
+// stored in zip files. The properties the stream was encoded with are given
+// by p. size is the uncompressed size, or -1 if unknown. eos tells whether the
+// stream is terminated by an end marker. The ReadCloser is a *Reader.
+//
+// If size is -1 and eos is false, the stream is assumed to end with its
+// input: decoding stops when r returns io.EOF between two symbols.
+//
+func NewReaderRaw(r io.Reader, p Props, size int64, eos bool) io.ReadCloser {
+	if size < -1 {
+		size = -1
+	}
+	zr := &Reader{r: r, raw: true, props: p, size: size, eos: eos}
+	zr.err = p.validate()
+	return zr
 }
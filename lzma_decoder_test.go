@@ -5,10 +5,15 @@
 package lzma
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
 	"io"
+	"io/ioutil"
 	"log"
+	"runtime"
 	"testing"
+	"unsafe"
 )
 
 func TestDecoder(t *testing.T) {
@@ -19,7 +24,7 @@ func TestDecoder(t *testing.T) {
 		defer r.Close()
 		b.Reset()
 		n, err := io.Copy(b, r)
-		if err != tt.err {
+		if !errors.Is(err, tt.err) {
 			t.Errorf("%s: io.Copy: %v, want %v", tt.descr, err, tt.err)
 		}
 		if err == nil { // if err != nil, there is little chance that data is decoded correctly, if at all
@@ -53,3 +58,454 @@ func BenchmarkDecoder(b *testing.B) {
 		log.Fatalf("%s: got %d-byte %q, want %d-byte %q", bench.descr, len(buf.Bytes()), buf.String(), len(bench.raw), bench.raw)
 	}
 }
+
+func TestDecoderRaw(t *testing.T) {
+	b := new(bytes.Buffer)
+	for _, tt := range lzmaTests {
+		if tt.err != nil {
+			continue
+		}
+		var p Props
+		p.decodeProps(tt.lzma)
+		size := int64(-1)
+		if tt.size == true {
+			size = int64(len(tt.raw))
+		}
+		r := NewReaderRaw(bytes.NewBuffer(tt.lzma[lzmaHeaderSize:]), p, size, !tt.size)
+		defer r.Close()
+		b.Reset()
+		_, err := io.Copy(b, r)
+		if err != nil {
+			t.Errorf("%s: io.Copy: %v", tt.descr, err)
+		}
+		if s := b.String(); s != tt.raw {
+			t.Errorf("%s: got %d-byte %q, want %d-byte %q", tt.descr, len(s), s, len(tt.raw), tt.raw)
+		}
+	}
+}
+
+// oneByteReader hides any method of r but Read and returns one byte at a time.
+type oneByteReader struct {
+	r io.Reader
+}
+
+func (o *oneByteReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return o.r.Read(p)
+}
+
+func TestReaderSmallReads(t *testing.T) {
+	r := NewReader(bytes.NewBuffer(bench.lzma))
+	defer r.Close()
+	b, err := ioutil.ReadAll(&oneByteReader{r})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !bytes.Equal(b, bench.raw) {
+		t.Fatalf("%s: got %d bytes, want %d bytes", bench.descr, len(b), len(bench.raw))
+	}
+}
+
+// byteOnlyReader hides any method of r but Read and ReadByte.
+type byteOnlyReader struct {
+	r *bytes.Reader
+}
+
+func (b *byteOnlyReader) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
+
+func (b *byteOnlyReader) ReadByte() (byte, error) {
+	return b.r.ReadByte()
+}
+
+// An io.ByteReader is read no further than the end of the stream, and needs no
+// UnreadByte to find the end of a raw stream without size nor end marker.
+func TestReaderByteReader(t *testing.T) {
+	br := bytes.NewReader(append(append([]byte{}, bench.lzma...), "suffix"...))
+	r := NewReaderConfig(&byteOnlyReader{br}, ReaderConfig{Lenient: true})
+	res, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(res, bench.raw) {
+		t.Errorf("got %d bytes, %v", len(res), err)
+	}
+	if br.Len() != len("suffix") {
+		t.Errorf("%d bytes left after the stream, want %d", br.Len(), len("suffix"))
+	}
+
+	b := new(bytes.Buffer)
+	w := NewWriterRaw(b, int64(len(bench.raw)), DefaultCompression, false)
+	w.Write(bench.raw)
+	w.Close()
+	p, _ := LevelProps(DefaultCompression)
+	res, err = ioutil.ReadAll(NewReaderRaw(&byteOnlyReader{bytes.NewReader(b.Bytes())}, p, -1, false))
+	if err != nil || !bytes.Equal(res, bench.raw) {
+		t.Errorf("got %d bytes, %v", len(res), err)
+	}
+}
+
+func TestReaderNoGoroutine(t *testing.T) {
+	n := runtime.NumGoroutine()
+	r := NewReader(bytes.NewBuffer(bench.lzma))
+	buf := make([]byte, 100)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if m := runtime.NumGoroutine(); m != n {
+		t.Errorf("%d goroutines running, want %d", m, n)
+	}
+	r.Close()
+	if _, err := r.Read(buf); err == nil {
+		t.Errorf("Read after Close succeeded")
+	}
+}
+
+func TestReaderReset(t *testing.T) {
+	b := new(bytes.Buffer)
+	zr := NewReader(nil).(*Reader)
+	for _, tt := range lzmaTests {
+		zr.Reset(bytes.NewBuffer(tt.lzma))
+		b.Reset()
+		_, err := io.Copy(b, zr)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: io.Copy: %v, want %v", tt.descr, err, tt.err)
+		}
+		if err == nil && b.String() != tt.raw {
+			t.Errorf("%s: got %q, want %q", tt.descr, b.String(), tt.raw)
+		}
+	}
+}
+
+func TestReaderMemLimit(t *testing.T) {
+	// a header announcing a 4 GiB dictionary
+	hostile := []byte{0x5d, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0}
+	r := NewReaderConfig(bytes.NewReader(hostile), ReaderConfig{MemLimit: 64 << 20})
+	if _, err := ioutil.ReadAll(r); err != ErrMemLimit {
+		t.Errorf("got error %v, want %v", err, ErrMemLimit)
+	}
+
+	// level 3 needs a 1 MiB dictionary for a stream of unknown size
+	tt := lzmaTests[1]
+	for _, limit := range []int64{1 << 20, 4 << 20} {
+		r = NewReaderConfig(bytes.NewReader(tt.lzma), ReaderConfig{MemLimit: limit})
+		b, err := ioutil.ReadAll(r)
+		if limit < 4<<20 {
+			if err != ErrMemLimit {
+				t.Errorf("limit %d: got error %v, want %v", limit, err, ErrMemLimit)
+			}
+			continue
+		}
+		if !errors.Is(err, tt.err) || string(b) != tt.raw {
+			t.Errorf("limit %d: got %q, %v; want %q, %v", limit, b, err, tt.raw, tt.err)
+		}
+	}
+}
+
+// allocated returns the number of bytes f allocates.
+func allocated(f func()) int64 {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	f()
+	runtime.ReadMemStats(&after)
+	return int64(after.TotalAlloc - before.TotalAlloc)
+}
+
+// decoderRounding is how much more than DecoderMemoryUsage the allocator may
+// take, rounding the allocations up to their size class: up to a page for the
+// window, and a few bytes for the small allocations.
+const decoderRounding = 9 << 10
+
+func TestDecoderMemoryUsage(t *testing.T) {
+	buf := make([]byte, 1000)
+	for _, p := range []Props{
+		{LC: 0, LP: 0, PB: 0, DictSize: 1 << 12},
+		{LC: 3, LP: 0, PB: 2, DictSize: 1 << 20},
+		{LC: 8, LP: 4, PB: 4, DictSize: 3 << 22},
+	} {
+		opts, _ := LevelOptions(BestSpeed)
+		opts.Props = p
+		b := new(bytes.Buffer)
+		w, _ := NewWriterOptions(b, opts)
+		w.Write([]byte(bench.raw[:1000]))
+		w.Close()
+		h, _ := ParseHeader(b.Bytes())
+		want := DecoderMemoryUsage(h)
+		r := &oneByteReader{bytes.NewReader(b.Bytes())}
+		got := allocated(func() { io.ReadFull(NewReader(r), buf) })
+		if got < want || got > want+decoderRounding {
+			t.Errorf("%+v: allocated %d bytes, computed %d", p, got, want)
+		}
+	}
+
+	// no input buffer for an io.ByteReader
+	h, _ := ParseHeader(bench.lzma)
+	want := DecoderMemoryUsage(h) - ioBufSize - int64(unsafe.Sizeof(bufio.Reader{}))
+	br := bytes.NewReader(bench.lzma)
+	if got := allocated(func() { io.ReadFull(NewReader(br), buf) }); got < want || got > want+decoderRounding {
+		t.Errorf("allocated %d bytes, want %d", got, want)
+	}
+}
+
+func TestReaderKnownSize(t *testing.T) {
+	// the hello world stream, announcing a 256 MiB dictionary
+	tt := lzmaTests[2]
+	h, _ := ParseHeader(tt.lzma)
+	h.DictSize = 1 << 28
+	hb, _ := h.MarshalBinary()
+	in := append(hb, tt.lzma[lzmaHeaderSize:]...)
+	if mem := DecoderMemoryUsage(h); mem > 1<<20 {
+		t.Errorf("computed %d bytes", mem)
+	}
+	var res []byte
+	var err error
+	if got := allocated(func() { res, err = ioutil.ReadAll(NewReader(bytes.NewReader(in))) }); got > 1<<20 {
+		t.Errorf("allocated %d bytes", got)
+	}
+	if err != nil || string(res) != tt.raw {
+		t.Errorf("got %q, %v; want %q", res, err, tt.raw)
+	}
+}
+
+func TestReaderMaxOutput(t *testing.T) {
+	data := readFile("data/data.txt")
+	buf := new(bytes.Buffer)
+	for _, size := range []int64{int64(len(data)), -1} {
+		buf.Reset()
+		w := NewWriterSize(buf, size)
+		w.Write(data)
+		w.Close()
+		for _, max := range []int64{1000, int64(len(data)) - 1, int64(len(data))} {
+			r := NewReaderConfig(bytes.NewReader(buf.Bytes()), ReaderConfig{MaxOutput: max})
+			b, err := ioutil.ReadAll(r)
+			switch {
+			case max < int64(len(data)) && err != ErrOutputLimit:
+				t.Errorf("size %d, max %d: got error %v, want %v", size, max, err, ErrOutputLimit)
+			case max < int64(len(data)) && size == -1 && int64(len(b)) != max:
+				t.Errorf("size %d, max %d: got %d bytes before the error", size, max, len(b))
+			case max < int64(len(data)) && size != -1 && len(b) != 0:
+				t.Errorf("size %d, max %d: got %d bytes, want none", size, max, len(b))
+			case max == int64(len(data)) && (err != nil || !bytes.Equal(b, data)):
+				t.Errorf("size %d, max %d: got %d bytes, %v", size, max, len(b), err)
+			}
+		}
+	}
+}
+
+func TestReaderStrict(t *testing.T) {
+	payload := []byte("strict, strict, strict end of stream\n")
+	p, _ := LevelProps(DefaultCompression)
+	encode := func(size int64, eos bool) []byte {
+		buf := new(bytes.Buffer)
+		w := NewWriterRaw(buf, size, DefaultCompression, eos)
+		w.Write(payload)
+		w.Close()
+		return buf.Bytes()
+	}
+	sized := encode(int64(len(payload)), false)
+	marked := encode(-1, true)
+	garbage := bytes.Repeat([]byte{0xa5}, 64)
+	tests := []struct {
+		descr  string
+		stream []byte
+		size   int64
+		eos    bool
+		err    error
+	}{
+		{"sized", sized, int64(len(payload)), false, nil},
+		{"marked", marked, -1, true, nil},
+		{"marker at size", marked, int64(len(payload)), true, nil},
+		{"no size, no marker", sized, -1, false, nil},
+		{"first byte", append([]byte{1}, sized[1:]...), int64(len(payload)), false, ErrBadFirstByte},
+		{"early marker", marked, int64(len(payload)) + 1, true, ErrEarlyEndMarker},
+		{"final code", append(marked[:len(marked)-1:len(marked)-1], marked[len(marked)-1]^1), -1, true, ErrBadFinalCode},
+		{"trailing data, sized", append(sized[:len(sized):len(sized)], garbage...), int64(len(payload)), false, ErrTrailingData},
+		{"trailing data, marked", append(marked[:len(marked):len(marked)], garbage...), -1, true, ErrTrailingData},
+		{"match overrun", sized, 10, false, ErrMatchOverrun},
+	}
+	for _, tt := range tests {
+		for _, lenient := range []bool{false, true} {
+			c := ReaderConfig{Lenient: lenient}
+			r := NewReaderRawConfig(bytes.NewReader(tt.stream), p, tt.size, tt.eos, c)
+			b, err := ioutil.ReadAll(r)
+			want := tt.err
+			if lenient {
+				want = nil
+			}
+			if !errors.Is(err, want) {
+				t.Errorf("%s, lenient %v: got error %v, want %v", tt.descr, lenient, err, want)
+			}
+			out := payload
+			if tt.size >= 0 && tt.size < int64(len(out)) {
+				out = out[:tt.size]
+			}
+			if err == nil && !bytes.Equal(b, out) {
+				t.Errorf("%s, lenient %v: got %q, want %q", tt.descr, lenient, b, out)
+			}
+		}
+	}
+}
+
+func TestReaderEndMarker(t *testing.T) {
+	payload := []byte("a known size and an end marker\n")
+	encode := func(marker bool) []byte {
+		opts, _ := LevelOptions(DefaultCompression)
+		opts.Size, opts.EndMarker = int64(len(payload)), marker
+		buf := new(bytes.Buffer)
+		w, _ := NewWriterOptions(buf, opts)
+		w.Write(payload)
+		w.Close()
+		return buf.Bytes()
+	}
+	sized, marked := encode(false), encode(true)
+	if len(marked) <= len(sized) {
+		t.Fatalf("got %d bytes with a marker, %d without", len(marked), len(sized))
+	}
+	tests := []struct {
+		stream []byte
+		policy MarkerPolicy
+		err    error
+	}{
+		{sized, MarkerAllowed, nil},
+		{marked, MarkerAllowed, nil},
+		{sized, MarkerRequired, ErrMissingEndMarker},
+		{marked, MarkerRequired, nil},
+		{sized, MarkerForbidden, nil},
+		{marked, MarkerForbidden, ErrForbiddenEndMarker},
+	}
+	for _, tt := range tests {
+		for _, lenient := range []bool{false, true} {
+			c := ReaderConfig{Lenient: lenient, EndMarker: tt.policy}
+			b, err := ioutil.ReadAll(NewReaderConfig(bytes.NewReader(tt.stream), c))
+			want := tt.err
+			if lenient {
+				want = nil
+			}
+			if !errors.Is(err, want) {
+				t.Errorf("%d bytes, policy %d, lenient %v: got error %v, want %v", len(tt.stream), tt.policy, lenient, err, want)
+			}
+			if err == nil && !bytes.Equal(b, payload) {
+				t.Errorf("%d bytes, policy %d, lenient %v: got %q, want %q", len(tt.stream), tt.policy, lenient, b, payload)
+			}
+		}
+	}
+}
+
+func TestReaderDict(t *testing.T) {
+	dict := []byte("a preset dictionary, ")
+	data := bytes.Repeat(dict, 100)
+	b := new(bytes.Buffer)
+	opts, _ := LevelOptions(BestSpeed)
+	w, _ := NewWriterDict(b, opts, dict)
+	w.Write(data)
+	w.Close()
+	h, _ := ParseHeader(b.Bytes())
+	cfg := ReaderConfig{Dict: dict}
+	r := NewReaderRawConfig(bytes.NewReader(b.Bytes()[lzmaHeaderSize:]), h.Props, -1, true, cfg)
+	res, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(res, data) {
+		t.Errorf("got %d bytes, %v", len(res), err)
+	}
+}
+
+func TestCorruptError(t *testing.T) {
+	data := readFile("data/data.txt")
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	w.Write(data)
+	w.Close()
+	stream := buf.Bytes()[:buf.Len()/2]
+	b, err := ioutil.ReadAll(NewReader(bytes.NewReader(stream)))
+	for _, target := range []error{ErrCorrupt, ErrUnexpectedEOF, io.ErrUnexpectedEOF} {
+		if !errors.Is(err, target) {
+			t.Errorf("truncated stream: got error %v, want %v", err, target)
+		}
+	}
+	var ce *CorruptError
+	if !errors.As(err, &ce) {
+		t.Fatalf("truncated stream: got error %T, want *CorruptError", err)
+	}
+	if ce.Offset != int64(len(stream)) || ce.Pos != int64(len(b)) {
+		t.Errorf("truncated stream: got offset %d, position %d; want %d, %d", ce.Offset, ce.Pos, len(stream), len(b))
+	}
+
+	header := []byte{0xff, 0, 0, 0x10, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	_, err = ioutil.ReadAll(NewReader(bytes.NewReader(header)))
+	if !errors.Is(err, ErrHeader) || !errors.Is(err, ErrCorrupt) || errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("bad header: got error %v, want %v", err, ErrHeader)
+	}
+	if !errors.As(err, &ce) || ce.Offset != lzmaHeaderSize || ce.Pos != 0 {
+		t.Errorf("bad header: got error %#v", err)
+	}
+
+	_, err = ioutil.ReadAll(NewReaderRaw(bytes.NewReader(stream), Props{LC: 9}, -1, true))
+	if !errors.Is(err, ErrInvalidOption) || errors.Is(err, ErrCorrupt) {
+		t.Errorf("bad props: got error %v, want %v", err, ErrInvalidOption)
+	}
+}
+
+func TestHeader(t *testing.T) {
+	for _, tt := range lzmaTests {
+		if tt.err != nil {
+			continue
+		}
+		h, err := ParseHeader(tt.lzma)
+		if err != nil {
+			t.Fatalf("%s: ParseHeader: %v", tt.descr, err)
+		}
+		if h.SizeKnown != tt.size || h.SizeKnown && h.UncompressedSize != int64(len(tt.raw)) {
+			t.Errorf("%s: got size %d, known %v", tt.descr, h.UncompressedSize, h.SizeKnown)
+		}
+		b, err := h.MarshalBinary()
+		if err != nil || !bytes.Equal(b, tt.lzma[:lzmaHeaderSize]) {
+			t.Errorf("%s: MarshalBinary: got %x, %v; want %x", tt.descr, b, err, tt.lzma[:lzmaHeaderSize])
+		}
+		rh, err := ReadHeader(bytes.NewReader(tt.lzma))
+		if err != nil || rh != h {
+			t.Errorf("%s: ReadHeader: got %+v, %v; want %+v", tt.descr, rh, err, h)
+		}
+		zr := NewReader(bytes.NewReader(tt.lzma)).(*Reader)
+		if _, ok := zr.Header(); ok {
+			t.Errorf("%s: Header available before Read", tt.descr)
+		}
+		ioutil.ReadAll(zr)
+		if zh, ok := zr.Header(); !ok || zh != h {
+			t.Errorf("%s: Reader.Header: got %+v, %v; want %+v", tt.descr, zh, ok, h)
+		}
+	}
+
+	if _, err := ParseHeader([]byte{0x5d, 0, 0, 0x10, 0}); err != ErrUnexpectedEOF {
+		t.Errorf("short header: got error %v, want %v", err, ErrUnexpectedEOF)
+	}
+	bad := []byte{9 * 5 * 5, 0, 0, 0x10, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	if _, err := ParseHeader(bad); err != ErrHeader {
+		t.Errorf("bad header: got error %v, want %v", err, ErrHeader)
+	}
+	h := Header{Props: Props{LC: 9}}
+	if _, err := h.MarshalBinary(); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("bad props: got error %v, want %v", err, ErrInvalidOption)
+	}
+}
+
+func TestReaderResetAllocs(t *testing.T) {
+	in := bytes.NewReader(bench.lzma)
+	zr := NewReader(in).(*Reader)
+	buf := make([]byte, 4096)
+	allocs := testing.AllocsPerRun(5, func() {
+		in.Reset(bench.lzma)
+		zr.Reset(in)
+		for {
+			_, err := zr.Read(buf)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("%v allocations per stream, want 0", allocs)
+	}
+}
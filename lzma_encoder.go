@@ -5,10 +5,13 @@
 package lzma
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
-	"strconv"
-	"strings"
+	"os"
+	"sync"
+	"unsafe"
 )
 
 const (
@@ -33,6 +36,35 @@ func (e *argumentValueError) Error() string {
 	return fmt.Sprintf("illegal argument value error: %s with value %v", e.msg, e.val)
 }
 
+// Unwrap returns ErrInvalidOption, so that errors.Is recognizes e.
+func (e *argumentValueError) Unwrap() error {
+	return ErrInvalidOption
+}
+
+// ErrSizeMismatch is returned by a Writer given more data, by Write, or less
+// data, by Close, than the size written in its header. The stream is left
+// unterminated, so that it cannot be mistaken for a valid one.
+var ErrSizeMismatch = errors.New("lzma: data size differs from the declared size")
+
+// A sizeError reports a Writer given n bytes, or more than n bytes if more is
+// set, while size bytes were declared.
+type sizeError struct {
+	size, n int64
+	more    bool
+}
+
+func (e *sizeError) Error() string {
+	if e.more {
+		return fmt.Sprintf("lzma: more than the declared %d bytes written", e.size)
+	}
+	return fmt.Sprintf("lzma: %d bytes written, %d declared", e.n, e.size)
+}
+
+// Unwrap returns ErrSizeMismatch, so that errors.Is recognizes e.
+func (e *sizeError) Unwrap() error {
+	return ErrSizeMismatch
+}
+
 // Report error and stop executing. Wraps error an osError for handlePanics() to
 // distinguish them from genuine panics.
 func throw(err error) {
@@ -53,84 +85,197 @@ func handlePanics(error *error) {
 	}
 }
 
-type syncPipeReader struct {
-	*io.PipeReader
-	closeChan chan bool
-}
-
-func (sr *syncPipeReader) CloseWithError(err error) error {
-	retErr := sr.PipeReader.CloseWithError(err)
-	sr.closeChan <- true // finish writer close
-	return retErr
-}
-
-type syncPipeWriter struct {
-	*io.PipeWriter
-	closeChan chan bool
-}
-
-func (sw *syncPipeWriter) Close() error {
-	err := sw.PipeWriter.Close()
-	<-sw.closeChan // wait for reader close
-	return err
-}
-
-func syncPipe() (*syncPipeReader, *syncPipeWriter) {
-	r, w := io.Pipe()
-	sr := &syncPipeReader{r, make(chan bool, 1)}
-	sw := &syncPipeWriter{w, sr.closeChan}
-	return sr, sw
-}
-
+// compressionLevel holds the parameters of a level in the levels table, and
+// the parameters of a running encoder, for which dictSize is in bytes.
 type compressionLevel struct {
 	dictSize        uint32 // d, 1 << dictSize
 	fastBytes       uint32 // fb
 	litContextBits  uint32 // lc
-	litPosStateBits uint32 // lp // not used
+	litPosStateBits uint32 // lp
 	posStateBits    uint32 // pb
 	matchFinder     string // mf
-	//compressionMode uint32 // a
-	//matchCycles     uint32 // mc
+	matchCycles     uint32 // mc, 0 for the match finder's default
+	compressionMode Mode   // a
 }
 
 // levels is intended to be constant, but there is no way to enforce this constraint
 var levels = []compressionLevel{
-	compressionLevel{},                        // 0
-	compressionLevel{16, 64, 3, 0, 2, "bt4"},  // 1
-	compressionLevel{18, 64, 3, 0, 2, "bt4"},  // 2
-	compressionLevel{20, 64, 3, 0, 2, "bt4"},  // 3
-	compressionLevel{22, 128, 3, 0, 2, "bt4"}, // 4
-	compressionLevel{23, 128, 3, 0, 2, "bt4"}, // 5
-	compressionLevel{24, 128, 3, 0, 2, "bt4"}, // 6
-	compressionLevel{25, 256, 3, 0, 2, "bt4"}, // 7
-	compressionLevel{26, 256, 3, 0, 2, "bt4"}, // 8
-	compressionLevel{27, 256, 3, 0, 2, "bt4"}, // 9
+	compressionLevel{}, // 0
+	compressionLevel{16, 64, 3, 0, 2, "bt4", 8, ModeFast},    // 1
+	compressionLevel{18, 64, 3, 0, 2, "bt4", 24, ModeFast},   // 2
+	compressionLevel{20, 64, 3, 0, 2, "bt4", 0, ModeNormal},  // 3
+	compressionLevel{22, 128, 3, 0, 2, "bt4", 0, ModeNormal}, // 4
+	compressionLevel{23, 128, 3, 0, 2, "bt4", 0, ModeNormal}, // 5
+	compressionLevel{24, 128, 3, 0, 2, "bt4", 0, ModeNormal}, // 6
+	compressionLevel{25, 256, 3, 0, 2, "bt4", 0, ModeNormal}, // 7
+	compressionLevel{26, 256, 3, 0, 2, "bt4", 0, ModeNormal}, // 8
+	compressionLevel{27, 256, 3, 0, 2, "bt4", 0, ModeNormal}, // 9
+}
+
+const (
+	// MinDictSize and MaxDictSize are the limits of WriterOptions.DictSize.
+	MinDictSize = 1 << 12
+	MaxDictSize = 1 << 29
+
+	// MinNiceLen and MaxNiceLen are the limits of WriterOptions.NiceLen.
+	MinNiceLen = 5
+	MaxNiceLen = kMatchMaxLen
+)
+
+// A Mode selects how the encoder chooses between literals and matches.
+type Mode int
+
+const (
+	// ModeNormal looks for the cheapest sequence of literals and matches
+	// over up to 4 KiB of input ahead (optimal parsing).
+	ModeNormal Mode = iota
+
+	// ModeFast takes the longest match at each position, unless a repeated
+	// distance or the match at the next position is almost as long, as the
+	// LZMA SDK does with algorithm 0. It is usually two to four times as
+	// fast as ModeNormal, for a few percent more output. Levels 1 and 2 use it.
+	ModeFast
+)
+
+// WriterOptions holds every parameter of the encoder. LevelOptions returns
+// the options behind each compression level, as a starting point for tuning.
+type WriterOptions struct {
+	// Props are the properties of the stream: the dictionary size, between
+	// MinDictSize and MaxDictSize, and lc, lp and pb. Text usually favours
+	// the default lc=3, lp=0, pb=2; data made of 4-byte words, lc=0, lp=2, pb=2.
+	// Some decoders, xz among them, accept .lzma files only if the dictionary
+	// size is 2^n or 2^n + 2^(n-1).
+	Props
+
+	// Size is the size of the data to be written, -1 if unknown. If it is
+	// known, the dictionary is no larger than the smallest size of the form
+	// 2^n or 2^n + 2^(n-1), at least MinDictSize, that holds the whole data,
+	// which saves memory on both sides.
+	Size int64
+
+	// NiceLen, the number of fast bytes, is the match length beyond which
+	// the encoder stops looking for a better match; between MinNiceLen and
+	// MaxNiceLen.
+	NiceLen uint32
+
+	// Mode is the compression mode, ModeNormal or ModeFast.
+	Mode Mode
+
+	// MatchFinder is the match finder: one of the binary trees "bt2", "bt3"
+	// and "bt4", or one of the hash chains "hc4" and "hc5", which use half
+	// the memory and are faster but find fewer matches. The digit is the
+	// number of bytes hashed to look for matches.
+	MatchFinder string
+
+	// Depth is the maximum number of match candidates the match finder
+	// checks at each position: a larger depth finds better matches, at the
+	// cost of speed. If zero, it depends on NiceLen, as in xz: 16 + NiceLen/2
+	// for the binary trees, 4 + NiceLen/4 for the hash chains.
+	Depth uint32
+
+	// EndMarker terminates the stream with an end marker. It is required if
+	// Size is -1, and costs 5 or 6 bytes. With a known size, it is optional:
+	// some decoders require it, as do zip entries with flag bit 1 set, see
+	// ReaderConfig.EndMarker.
+	EndMarker bool
+
+	// PriceStats makes the Writer estimate the cost in bits of the symbols
+	// it encodes, given by the bit fields of Writer.Stats, which are zero
+	// otherwise. Pricing every bit encoded slows the Writer down a little.
+	PriceStats bool
 }
 
-func (cl *compressionLevel) checkValues() {
-	if cl.dictSize < 12 || cl.dictSize > 29 {
-		throw(&argumentValueError{"dictionary size out of range", cl.dictSize})
+// Validate returns an error matching ErrInvalidOption if o is not usable.
+func (o *WriterOptions) Validate() error {
+	return o.validate(false)
+}
+
+// validate is Validate for a Writer that can patch the size into the header,
+// for which an unknown size needs no end marker.
+func (o *WriterOptions) validate(seekable bool) error {
+	if o.DictSize < MinDictSize || o.DictSize > MaxDictSize {
+		return &argumentValueError{"dictionary size out of range", o.DictSize}
+	}
+	if o.NiceLen < MinNiceLen || o.NiceLen > MaxNiceLen {
+		return &argumentValueError{"number of fast bytes out of range", o.NiceLen}
+	}
+	if err := o.Props.validate(); err != nil {
+		return err
 	}
-	if cl.fastBytes < 5 || cl.fastBytes > 273 {
-		throw(&argumentValueError{"number of fast bytes out of range", cl.fastBytes})
+	if o.Mode != ModeNormal && o.Mode != ModeFast {
+		return &argumentValueError{"unknown compression mode", o.Mode}
 	}
-	if cl.litContextBits < 0 || cl.litContextBits > 8 {
-		throw(&argumentValueError{"number of literal context bits out of range", cl.litContextBits})
+	if _, ok := matchFinders[o.MatchFinder]; !ok {
+		return &argumentValueError{"unsuported match finder", o.MatchFinder}
 	}
-	if cl.litPosStateBits < 0 || cl.litPosStateBits > 4 {
-		throw(&argumentValueError{"number of literal position bits out of range", cl.litPosStateBits})
+	if o.Size < -1 { // size can be equal to zero
+		return &argumentValueError{"illegal size", o.Size}
 	}
-	if cl.posStateBits < 0 || cl.posStateBits > 4 {
-		throw(&argumentValueError{"number of position bits out of range", cl.posStateBits})
+	if o.Size == -1 && !o.EndMarker && !seekable {
+		return &argumentValueError{"end marker required with unknown size", o.EndMarker}
 	}
-	if cl.matchFinder != "bt2" && cl.matchFinder != "bt4" {
-		throw(&argumentValueError{"unsuported match finder", cl.matchFinder})
+	return nil
+}
+
+// EncoderMemoryUsage returns the number of bytes a Writer allocates to encode
+// with the options opts, of which the window and the match finder take the
+// most: about 11.5 times the dictionary size with bt4, 7.5 times with hc4.
+// This counts the Writer itself and its 4 KiB output buffer, which a Writer to
+// an io.Writer with WriteByte and Flush, such as a *bufio.Writer, does without;
+// the allocator rounds each allocation up a little more. NewWriterDict does
+// not copy dict, but the dictionary must hold it too: for such a Writer, add
+// len(dict) to opts.Size if known. An error matching ErrInvalidOption is
+// returned if opts is not valid.
+//
+func EncoderMemoryUsage(opts WriterOptions) (int64, error) {
+	if err := opts.Validate(); err != nil {
+		return 0, err
 	}
+	return encoderMemUsage(&opts, 0), nil
+}
+
+// LevelOptions returns the options used by the compression level level, with
+// Size -1 and EndMarker set.
+//
+// The levels deliberately differ from the presets of xz: they keep the
+// dictionary sizes of the LZMA SDK, and all use bt4, where xz presets 0 to 3
+// use hc3 or hc4 with their own depths. Options set explicitly give the xz
+// parameters if needed.
+//
+func LevelOptions(level int) (WriterOptions, error) {
+	if level < BestSpeed || level > BestCompression {
+		return WriterOptions{}, &argumentValueError{"level out of range", level}
+	}
+	cl := &levels[level]
+	return WriterOptions{
+		Props: Props{
+			LC:       uint8(cl.litContextBits),
+			LP:       uint8(cl.litPosStateBits),
+			PB:       uint8(cl.posStateBits),
+			DictSize: 1 << cl.dictSize,
+		},
+		Size:        -1,
+		NiceLen:     cl.fastBytes,
+		Mode:        cl.compressionMode,
+		MatchFinder: cl.matchFinder,
+		Depth:       cl.matchCycles,
+		EndMarker:   true,
+	}, nil
+}
+
+// tablesOnce guards the initialization of the tables used by the encoder only,
+// which are read only afterwards, so that encoders can run concurrently.
+var tablesOnce sync.Once
+
+func initTables() {
+	initProbPrices()
+	initCrcTable()
+	initGFastPos()
 }
 
 var gFastPos []byte = make([]byte, 1<<11)
 
-// should be called in the encoder's contructor
+// should be called through tablesOnce
 func initGFastPos() {
 	kFastSlots := 22
 	c := 2
@@ -198,8 +343,6 @@ func (o *optimal) isShortRep() bool {
 }
 
 const (
-	eMatchFinderTypeBT2  = 0
-	eMatchFinderTypeBT4  = 1
 	kInfinityPrice       = 0x0FFFFFFF
 	kDefaultDicLogSize   = 22
 	kNumFastBytesDefault = 0x20
@@ -210,11 +353,15 @@ const (
 type encoder struct {
 	// i/o, range encoder and match finder
 	re *rangeEncoder // w
-	mf *lzBinTree    // r
+	mf matchFinder   // r
+	iw *lzInWindow   // window of mf
 
-	cl           *compressionLevel
+	cl           compressionLevel
+	header       [lzmaHeaderSize]byte
 	size         int64
-	writeEndMark bool // eos
+	writeEndMark bool        // eos
+	preset       io.ReaderAt // preset dictionary or patch reference
+	presetSize   int64       // size of preset
 
 	optimum []*optimal
 
@@ -249,6 +396,7 @@ type encoder struct {
 
 	posSlotPrices   []uint32
 	distancesPrices []uint32
+	tempPrices      []uint32 // scratch space of fillDistancesPrices
 	alignPrices     []uint32
 	alignPriceCount uint32
 
@@ -259,8 +407,6 @@ type encoder struct {
 	nowPos   int64
 	finished bool
 
-	matchFinderType uint32
-
 	state           uint32
 	prevByte        byte
 	repDistances    []uint32
@@ -269,6 +415,9 @@ type encoder struct {
 	reps    []uint32
 	repLens []uint32
 	backRes uint32
+
+	stats   Stats
+	pricing bool // fill in the bit fields of stats, see WriterOptions.PriceStats
 }
 
 func (z *encoder) readMatchDistances() (lenRes uint32) {
@@ -277,7 +426,7 @@ func (z *encoder) readMatchDistances() (lenRes uint32) {
 	if z.distancePairs > 0 {
 		lenRes = z.matchDistances[z.distancePairs-2]
 		if lenRes == z.cl.fastBytes {
-			lenRes += z.mf.iw.getMatchLen(int32(lenRes)-1, z.matchDistances[z.distancePairs-1], kMatchMaxLen-lenRes)
+			lenRes += z.iw.getMatchLen(int32(lenRes)-1, z.matchDistances[z.distancePairs-1], kMatchMaxLen-lenRes)
 		}
 	}
 	z.additionalOffset++
@@ -376,7 +525,7 @@ func (z *encoder) getOptimum(position uint32) (res uint32) {
 		z.longestMatchFound = false
 	}
 	distancePairs = z.distancePairs
-	availableBytes := z.mf.iw.getNumAvailableBytes() + 1
+	availableBytes := z.iw.getNumAvailableBytes() + 1
 	if availableBytes < 2 {
 		z.backRes = 0xFFFFFFFF
 		res = 1
@@ -389,7 +538,7 @@ func (z *encoder) getOptimum(position uint32) (res uint32) {
 	repMaxIndex := uint32(0)
 	for i := uint32(0); i < kNumRepDistances; i++ {
 		z.reps[i] = z.repDistances[i]
-		z.repLens[i] = z.mf.iw.getMatchLen(0-1, z.reps[i], kMatchMaxLen)
+		z.repLens[i] = z.iw.getMatchLen(0-1, z.reps[i], kMatchMaxLen)
 		if z.repLens[i] > z.repLens[repMaxIndex] {
 			repMaxIndex = i
 		}
@@ -409,8 +558,8 @@ func (z *encoder) getOptimum(position uint32) (res uint32) {
 		return
 	}
 
-	curByte := z.mf.iw.getIndexByte(0 - 1)
-	matchByte := z.mf.iw.getIndexByte(0 - int32(z.repDistances[0]) - 1 - 1)
+	curByte := z.iw.getIndexByte(0 - 1)
+	matchByte := z.iw.getIndexByte(0 - int32(z.repDistances[0]) - 1 - 1)
 	if lenMain < 2 && curByte != matchByte && z.repLens[repMaxIndex] < 2 {
 		z.backRes = 0xFFFFFFFF
 		res = 1
@@ -596,11 +745,11 @@ DoWhile1:
 		z.optimum[cur].backs2 = z.reps[2]
 		z.optimum[cur].backs3 = z.reps[3]
 		curPrice := z.optimum[cur].price
-		curByte = z.mf.iw.getIndexByte(0 - 1)
-		matchByte = z.mf.iw.getIndexByte(0 - int32(z.reps[0]) - 1 - 1)
+		curByte = z.iw.getIndexByte(0 - 1)
+		matchByte = z.iw.getIndexByte(0 - int32(z.reps[0]) - 1 - 1)
 		posState = position & z.posStateMask
 		curAnd1Price := curPrice + getPrice0(z.isMatch[state<<kNumPosStatesBitsMax+posState]) +
-			z.litCoder.getSubCoder(position, z.mf.iw.getIndexByte(0-2)).getPrice(!stateIsCharState(state), matchByte, curByte)
+			z.litCoder.getSubCoder(position, z.iw.getIndexByte(0-2)).getPrice(!stateIsCharState(state), matchByte, curByte)
 
 		nextOptimum := z.optimum[cur+1]
 		nextIsChar := false
@@ -623,7 +772,7 @@ DoWhile1:
 			}
 		}
 
-		availableBytesFull := z.mf.iw.getNumAvailableBytes() + 1
+		availableBytesFull := z.iw.getNumAvailableBytes() + 1
 		availableBytesFull = minUInt32(kNumOpts-1-cur, availableBytesFull)
 		availableBytes = availableBytesFull
 		if availableBytes < 2 {
@@ -634,7 +783,7 @@ DoWhile1:
 		}
 		if nextIsChar == false && matchByte != curByte {
 			t := minUInt32(availableBytesFull-1, z.cl.fastBytes)
-			lenTest2 := z.mf.iw.getMatchLen(0, z.reps[0], t)
+			lenTest2 := z.iw.getMatchLen(0, z.reps[0], t)
 			if lenTest2 >= 2 {
 				state2 := stateUpdateChar(state)
 				posStateNext := (position + 1) & z.posStateMask
@@ -659,7 +808,7 @@ DoWhile1:
 
 		startLen := uint32(2)
 		for repIndex := uint32(0); repIndex < kNumRepDistances; repIndex++ {
-			lenTest := z.mf.iw.getMatchLen(0-1, z.reps[repIndex], availableBytes)
+			lenTest := z.iw.getMatchLen(0-1, z.reps[repIndex], availableBytes)
 			if lenTest < 2 {
 				continue
 			}
@@ -688,14 +837,14 @@ DoWhile1:
 
 			if lenTest < availableBytesFull {
 				t := minUInt32(availableBytesFull-1-lenTest, z.cl.fastBytes)
-				lenTest2 := z.mf.iw.getMatchLen(int32(lenTest), z.reps[repIndex], t)
+				lenTest2 := z.iw.getMatchLen(int32(lenTest), z.reps[repIndex], t)
 				if lenTest2 >= 2 {
 					state2 := stateUpdateRep(state)
 					posStateNext := (position + lenTest) & z.posStateMask
 					curAndLenCharPrice := repMatchPrice + z.getRepPrice(repIndex, lenTest, state, posState) +
 						getPrice0(z.isMatch[state2<<kNumPosStatesBitsMax+posStateNext]) +
-						z.litCoder.getSubCoder(position+lenTest, z.mf.iw.getIndexByte(int32(lenTest)-1-1)).getPrice(
-							true, z.mf.iw.getIndexByte(int32(lenTest)-1-(int32(z.reps[repIndex]+1))), z.mf.iw.getIndexByte(int32(lenTest)-1))
+						z.litCoder.getSubCoder(position+lenTest, z.iw.getIndexByte(int32(lenTest)-1-1)).getPrice(
+							true, z.iw.getIndexByte(int32(lenTest)-1-(int32(z.reps[repIndex]+1))), z.iw.getIndexByte(int32(lenTest)-1))
 					state2 = stateUpdateChar(state2)
 					posStateNext = (position + lenTest + 1) & z.posStateMask
 					nextMatchPrice := curAndLenCharPrice + getPrice1(z.isMatch[state2<<kNumPosStatesBitsMax+posStateNext])
@@ -753,15 +902,15 @@ DoWhile1:
 				if lenTest == z.matchDistances[offs] {
 					if lenTest < availableBytesFull {
 						t := minUInt32(availableBytesFull-1-lenTest, z.cl.fastBytes)
-						lenTest2 := z.mf.iw.getMatchLen(int32(lenTest), curBack, t)
+						lenTest2 := z.iw.getMatchLen(int32(lenTest), curBack, t)
 						if lenTest2 >= 2 {
 							state2 := stateUpdateMatch(state)
 							posStateNext := (position + lenTest) & z.posStateMask
 							curAndLenCharPrice := curAndLenPrice +
 								getPrice0(z.isMatch[state2<<kNumPosStatesBitsMax+posStateNext]) +
-								z.litCoder.getSubCoder(position+lenTest, z.mf.iw.getIndexByte(int32(lenTest)-1-1)).getPrice(
-									true, z.mf.iw.getIndexByte(int32(lenTest)-(int32(curBack)+1)-1),
-									z.mf.iw.getIndexByte(int32(lenTest)-1))
+								z.litCoder.getSubCoder(position+lenTest, z.iw.getIndexByte(int32(lenTest)-1-1)).getPrice(
+									true, z.iw.getIndexByte(int32(lenTest)-(int32(curBack)+1)-1),
+									z.iw.getIndexByte(int32(lenTest)-1))
 
 							state2 = stateUpdateChar(state2)
 							posStateNext = (position + lenTest + 1) & z.posStateMask
@@ -793,17 +942,117 @@ DoWhile1:
 			}
 		}
 	}
-	return
 }
 
-var tempPrices []uint32 = make([]uint32, kNumFullDistances)
+// changePair reports whether a match at distance bigDist is worth less than
+// a match one byte shorter at distance smallDist.
+func changePair(smallDist, bigDist uint32) bool {
+	return bigDist>>7 > smallDist
+}
+
+// getOptimumFast is getOptimum for ModeFast: rather than comparing the prices
+// of all the ways to encode the coming bytes, it takes the longest match,
+// unless a repeated distance almost as long, or a better match starting at
+// the next byte, makes it worth encoding something else.
+func (z *encoder) getOptimumFast() uint32 {
+	var lenMain uint32
+	if z.longestMatchFound == false {
+		lenMain = z.readMatchDistances()
+	} else {
+		lenMain = z.longestMatchLen
+		z.longestMatchFound = false
+	}
+	distancePairs := z.distancePairs
+	z.backRes = 0xFFFFFFFF
+	availableBytes := z.iw.getNumAvailableBytes() + 1
+	if availableBytes < 2 {
+		return 1
+	}
+	if availableBytes > kMatchMaxLen {
+		availableBytes = kMatchMaxLen
+	}
+
+	repLen, repIndex := uint32(0), uint32(0)
+	for i := uint32(0); i < kNumRepDistances; i++ {
+		length := z.iw.getMatchLen(0-1, z.repDistances[i], availableBytes)
+		if length < 2 {
+			continue
+		}
+		if length >= z.cl.fastBytes {
+			z.backRes = i
+			z.movePos(length - 1)
+			return length
+		}
+		if length > repLen {
+			repLen, repIndex = length, i
+		}
+	}
+
+	if lenMain >= z.cl.fastBytes {
+		z.backRes = z.matchDistances[distancePairs-1] + kNumRepDistances
+		z.movePos(lenMain - 1)
+		return lenMain
+	}
+
+	mainDist := uint32(0)
+	if lenMain >= 2 {
+		mainDist = z.matchDistances[distancePairs-1]
+		for distancePairs > 2 && lenMain == z.matchDistances[distancePairs-4]+1 {
+			if !changePair(z.matchDistances[distancePairs-3], mainDist) {
+				break
+			}
+			distancePairs -= 2
+			lenMain = z.matchDistances[distancePairs-2]
+			mainDist = z.matchDistances[distancePairs-1]
+		}
+		if lenMain == 2 && mainDist >= 0x80 {
+			lenMain = 1
+		}
+	}
+
+	if repLen >= 2 && (repLen+1 >= lenMain ||
+		repLen+2 >= lenMain && mainDist >= 1<<9 ||
+		repLen+3 >= lenMain && mainDist >= 1<<15) {
+		z.backRes = repIndex
+		z.movePos(repLen - 1)
+		return repLen
+	}
+
+	if lenMain < 2 || availableBytes <= 2 {
+		return 1
+	}
+
+	// a literal is better if the next byte starts a longer or closer match
+	z.longestMatchLen = z.readMatchDistances()
+	z.longestMatchFound = true
+	if z.longestMatchLen >= 2 {
+		newDist := z.matchDistances[z.distancePairs-1]
+		if z.longestMatchLen >= lenMain && newDist < mainDist ||
+			z.longestMatchLen == lenMain+1 && !changePair(mainDist, newDist) ||
+			z.longestMatchLen > lenMain+1 ||
+			z.longestMatchLen+1 >= lenMain && lenMain >= 3 && changePair(newDist, mainDist) {
+			return 1
+		}
+	}
+	// or a repeated distance
+	for i := uint32(0); i < kNumRepDistances; i++ {
+		length := z.iw.getMatchLen(0-1, z.repDistances[i], maxUInt32(lenMain-1, 2))
+		if length >= 2 && length >= lenMain-1 {
+			return 1
+		}
+	}
+	z.longestMatchFound = false
+	z.backRes = mainDist + kNumRepDistances
+	z.movePos(lenMain - 2)
+	return lenMain
+}
 
 func (z *encoder) fillDistancesPrices() {
 	for i := uint32(kStartPosModelIndex); i < kNumFullDistances; i++ {
 		posSlot := getPosSlot(i)
 		footerBits := posSlot>>1 - 1
 		baseVal := (2 | posSlot&1) << footerBits
-		tempPrices[i] = reverseGetPriceIndex(z.posCoders, baseVal-posSlot-1, footerBits, i-baseVal)
+		z.tempPrices[i] = reverseGetPriceIndex(z.posCoders, baseVal-posSlot-1, footerBits, i-baseVal)
 	}
 	for lenToPosState := uint32(0); lenToPosState < kNumLenToPosStates; lenToPosState++ {
 		var posSlot uint32
@@ -820,7 +1069,7 @@ func (z *encoder) fillDistancesPrices() {
 			z.distancesPrices[st2+i] = z.posSlotPrices[st+i]
 		}
 		for ; i < kNumFullDistances; i++ {
-			z.distancesPrices[st2+i] = z.posSlotPrices[st+getPosSlot(i)] + tempPrices[i]
+			z.distancesPrices[st2+i] = z.posSlotPrices[st+getPosSlot(i)] + z.tempPrices[i]
 		}
 	}
 	z.matchPriceCount = 0
@@ -841,7 +1090,7 @@ func (z *encoder) writeEndMarker(posState uint32) {
 	z.re.encode(z.isRep, z.state, 0)
 	z.state = stateUpdateMatch(z.state)
 	length := kMatchMinLen
-	z.lenCoder.encode(z.re, 0, posState) // 0 is length - kMatchMinLen
+	z.lenCoder.encode(z.re, 0, posState, z.cl.compressionMode == ModeNormal) // 0 is length - kMatchMinLen
 	posSlot := 1<<kNumPosSlotBits - 1
 	lenToPosState := getLenToPosState(uint32(length))
 	z.posSlotCoders[lenToPosState].encode(z.re, uint32(posSlot))
@@ -854,44 +1103,74 @@ func (z *encoder) writeEndMarker(posState uint32) {
 func (z *encoder) flush(nowPos uint32) {
 	z.writeEndMarker(nowPos & z.posStateMask)
 	z.re.flush()
+	z.finished = true
+}
+
+// needInput reports whether more input must be buffered before encoding can
+// go on. Until the input is complete, getOptimum is always given at least
+// kNumOpts bytes of lookahead (plus what the match finder reads past them),
+// so that the result does not depend on how the input is split into writes.
+func (z *encoder) needInput() bool {
+	iw := z.iw
+	return !iw.streamEnd && iw.getNumAvailableBytes() < kNumOpts+iw.keepSizeAfter
 }
 
+// codeOneBlock encodes about 4 KiB of input. It returns early if more input is
+// needed, and sets z.finished once all input is encoded and the stream flushed.
 func (z *encoder) codeOneBlock() {
-	z.finished = true
 	progressPosValuePrev := z.nowPos
+	if z.needInput() {
+		return
+	}
 	if z.nowPos == 0 {
-		if z.mf.iw.getNumAvailableBytes() == 0 {
+		if z.iw.getNumAvailableBytes() == 0 {
 			z.flush(uint32(z.nowPos))
 			return
 		}
 		_ = z.readMatchDistances()
+		price := z.re.price
 		z.re.encode(z.isMatch, z.state<<kNumPosStatesBitsMax+uint32(z.nowPos)&z.posStateMask, 0)
 		z.state = stateUpdateChar(z.state)
-		curByte := z.mf.iw.getIndexByte(0 - int32(z.additionalOffset))
+		curByte := z.iw.getIndexByte(0 - int32(z.additionalOffset))
 		z.litCoder.getSubCoder(uint32(z.nowPos), z.prevByte).encode(z.re, curByte)
+		z.stats.Literals++
+		z.stats.LiteralBits += priceBits(z.re.price - price)
 		z.prevByte = curByte
 		z.additionalOffset--
 		z.nowPos++
 	}
-	if z.mf.iw.getNumAvailableBytes() == 0 {
+	if z.iw.getNumAvailableBytes() == 0 {
 		z.flush(uint32(z.nowPos))
 		return
 	}
 	for {
-		length := z.getOptimum(uint32(z.nowPos))
+		if z.needInput() {
+			return
+		}
+		var length uint32
+		if z.cl.compressionMode == ModeFast {
+			length = z.getOptimumFast()
+		} else {
+			length = z.getOptimum(uint32(z.nowPos))
+		}
 		pos := z.backRes
 		posState := uint32(z.nowPos) & z.posStateMask
 		complexState := z.state<<kNumPosStatesBitsMax + posState
+		price := z.re.price
 
 		if length == 1 && pos == 0xFFFFFFFF {
 			z.re.encode(z.isMatch, complexState, 0)
-			curByte := z.mf.iw.getIndexByte(0 - int32(z.additionalOffset))
+			curByte := z.iw.getIndexByte(0 - int32(z.additionalOffset))
 			lsc := z.litCoder.getSubCoder(uint32(z.nowPos), z.prevByte)
 			if stateIsCharState(z.state) == false {
-				matchByte := z.mf.iw.getIndexByte(0 - int32(z.repDistances[0]) - 1 - int32(z.additionalOffset))
+				matchByte := z.iw.getIndexByte(0 - int32(z.repDistances[0]) - 1 - int32(z.additionalOffset))
 				lsc.encodeMatched(z.re, matchByte, curByte)
+				z.stats.MatchedLiterals++
+				z.stats.MatchedLiteralBits += priceBits(z.re.price - price)
 			} else {
 				lsc.encode(z.re, curByte)
+				z.stats.Literals++
+				z.stats.LiteralBits += priceBits(z.re.price - price)
 			}
 			z.prevByte = curByte
 			z.state = stateUpdateChar(z.state)
@@ -917,9 +1196,13 @@ func (z *encoder) codeOneBlock() {
 				}
 				if length == 1 {
 					z.state = stateUpdateShortRep(z.state)
+					z.stats.ShortReps++
+					z.stats.ShortRepBits += priceBits(z.re.price - price)
 				} else {
-					z.repMatchLenCoder.encode(z.re, length-kMatchMinLen, posState)
+					z.repMatchLenCoder.encode(z.re, length-kMatchMinLen, posState, z.cl.compressionMode == ModeNormal)
 					z.state = stateUpdateRep(z.state)
+					z.stats.Reps[pos]++
+					z.stats.RepBits[pos] += priceBits(z.re.price - price)
 				}
 				distance := z.repDistances[pos]
 				if pos != 0 {
@@ -931,7 +1214,7 @@ func (z *encoder) codeOneBlock() {
 			} else {
 				z.re.encode(z.isRep, z.state, 0)
 				z.state = stateUpdateMatch(z.state)
-				z.lenCoder.encode(z.re, length-kMatchMinLen, posState)
+				z.lenCoder.encode(z.re, length-kMatchMinLen, posState, z.cl.compressionMode == ModeNormal)
 				pos -= kNumRepDistances
 				posSlot := getPosSlot(pos)
 				lenToPosState := getLenToPosState(length)
@@ -953,122 +1236,181 @@ func (z *encoder) codeOneBlock() {
 				}
 				z.repDistances[0] = pos
 				z.matchPriceCount++
+				z.stats.Matches++
+				z.stats.MatchBits += priceBits(z.re.price - price)
+				z.stats.DistSlots[posSlot]++
 			}
-			z.prevByte = z.mf.iw.getIndexByte(int32(length) - 1 - int32(z.additionalOffset))
+			z.stats.MatchLens[length]++
+			z.prevByte = z.iw.getIndexByte(int32(length) - 1 - int32(z.additionalOffset))
 		}
 		z.additionalOffset -= length
 		z.nowPos += int64(length)
 		if z.additionalOffset == 0 {
-			if z.matchPriceCount >= 1<<7 {
-				z.fillDistancesPrices()
-			}
-			if z.alignPriceCount >= kAlignTableSize {
-				z.fillAlignPrices()
+			// ModeFast does not look at prices
+			if z.cl.compressionMode == ModeNormal {
+				if z.matchPriceCount >= 1<<7 {
+					z.fillDistancesPrices()
+				}
+				if z.alignPriceCount >= kAlignTableSize {
+					z.fillAlignPrices()
+				}
 			}
-			if z.mf.iw.getNumAvailableBytes() == 0 {
+			if z.iw.getNumAvailableBytes() == 0 {
 				z.flush(uint32(z.nowPos))
 				return
 			}
 			if z.nowPos-progressPosValuePrev >= 1<<12 {
-				z.finished = false
 				return
 			}
 		}
 	}
 }
 
-func (z *encoder) doEncode() {
-	for {
-		z.codeOneBlock()
-		if z.finished == true {
+// dictSizeFor returns the size of the dictionary used to encode size bytes,
+// -1 if unknown, given a dictionary of dictSize bytes.
+func dictSizeFor(dictSize uint32, size int64) uint32 {
+	if size < 0 || size >= int64(dictSize) {
+		return dictSize
+	}
+	n := uint32(MinDictSize)
+	for ; int64(n) < size; n <<= 1 {
+		if int64(n+n>>1) >= size {
+			n += n >> 1
 			break
 		}
 	}
+	return minUInt32(n, dictSize)
 }
 
-func (z *encoder) encoder(r io.Reader, w io.Writer, size int64, level int) (err error) {
-	defer handlePanics(&err)
+// setup prepares z to encode with the options o, without an end marker if
+// patch, see NewWriterSeeker.
+func (z *encoder) setup(o *WriterOptions, patch bool) {
+	tablesOnce.Do(initTables)
 
-	// these functions are good candidates for init() but the decoder doesn't need them
-	initProbPrices()
-	initCrcTable()
-	initGFastPos()
-
-	if level < 1 || level > 9 {
-		return &argumentValueError{"level out of range", level}
+	if err := o.validate(patch); err != nil {
+		throw(err)
 	}
-	// do not asign &levels[level] directly to z.cl because dictSize is modified later
-	// and the next run of this funcion with the same compression level will fail;
-	// levels is intended to be const, but there is no way enforce this constraint.
-	cl := levels[level]
-	z.cl = &cl
-	z.cl.checkValues()
-	z.distTableSize = z.cl.dictSize * 2
-	z.cl.dictSize = 1 << z.cl.dictSize
-	if size < -1 { // size can be equal to zero
-		return &argumentValueError{"illegal size", size}
+	z.cl = compressionLevel{
+		dictSize:        dictSizeFor(o.DictSize, z.span(o.Size)),
+		fastBytes:       o.NiceLen,
+		litContextBits:  uint32(o.LC),
+		litPosStateBits: uint32(o.LP),
+		posStateBits:    uint32(o.PB),
+		matchFinder:     o.MatchFinder,
+		matchCycles:     o.Depth,
+		compressionMode: o.Mode,
 	}
-	z.size = size
-	z.writeEndMark = false
-	if z.size == -1 {
-		z.writeEndMark = true
+	dictLog := uint32(0)
+	for z.cl.dictSize > 1<<dictLog {
+		dictLog++
 	}
+	z.distTableSize = dictLog * 2
+	z.size = o.Size
+	z.writeEndMark = o.EndMarker && !patch
+	z.pricing = o.PriceStats
+}
 
-	header := make([]byte, lzmaHeaderSize)
-	header[0] = byte((z.cl.posStateBits*5+z.cl.litPosStateBits)*9 + z.cl.litContextBits)
-	for i := uint32(0); i < 4; i++ {
-		header[i+1] = byte(z.cl.dictSize >> (8 * i))
-	}
-	for i := uint32(0); i < 8; i++ {
-		header[i+lzmaPropSize] = byte(z.size >> (8 * i))
+func (z *encoder) props() *Props {
+	return &Props{
+		LC:       uint8(z.cl.litContextBits),
+		LP:       uint8(z.cl.litPosStateBits),
+		PB:       uint8(z.cl.posStateBits),
+		DictSize: z.cl.dictSize,
 	}
+}
+
+func (z *encoder) writeHeader(w io.Writer) {
+	header := z.header[:]
+	h := Header{Props: *z.props(), UncompressedSize: z.size, SizeKnown: z.size != -1}
+	h.encode(header)
 	n, err := w.Write(header)
 	if err != nil {
-		return
+		throw(err)
 	}
 	if n != len(header) {
-		return nWriteError
+		throw(io.ErrShortWrite)
 	}
+}
 
-	// do not move before w.Write(header)
-	z.re = newRangeEncoder(w)
-	mft, err := strconv.ParseUint(strings.Split(z.cl.matchFinder, "")[2], 10, 64)
-	if err != nil {
-		return
+// encoderMemUsage returns the number of bytes a Writer allocates to encode
+// with the options o after a preset of presetSize bytes: the Writer itself,
+// with the encoder, and what init allocates.
+func encoderMemUsage(o *WriterOptions, presetSize int64) int64 {
+	span := o.Size
+	if span >= 0 {
+		span += presetSize
 	}
-	z.matchFinderType = uint32(mft)
-	numHashBytes := uint32(4)
-	if z.matchFinderType == eMatchFinderTypeBT2 {
-		numHashBytes = 2
-	}
-	z.mf = newLzBinTree(r, z.cl.dictSize, kNumOpts, z.cl.fastBytes, kMatchMaxLen+1, numHashBytes)
+	numPosStates := uint32(1) << o.PB
+	mem := int64(unsafe.Sizeof(Writer{})) + rangeEncoderMemUsage()
+	mem += matchFinderMemUsage(o.MatchFinder, dictSizeFor(o.DictSize, span), kNumOpts, o.NiceLen, kMatchMaxLen+1)
+	mem += kNumOpts * int64(unsafe.Sizeof(&optimal{})+unsafe.Sizeof(optimal{}))
+	mem += 2 * lenPriceTableCoderMemUsage(numPosStates)
+	mem += litCoderMemUsage(uint32(o.LP), uint32(o.LC))
+	mem += modelsMemUsage()
+	prices := int64(kMatchMaxLen*2 + 2) // matchDistances
+	prices += 1<<(kNumPosSlotBits+kNumLenToPosStatesBits) + kNumFullDistances<<kNumLenToPosStatesBits + kNumFullDistances + kAlignTableSize
+	prices += 3 * kNumRepDistances // repDistances, reps and repLens
+	return mem + 4*prices
+}
 
-	z.optimum = make([]*optimal, kNumOpts)
-	for i := 0; i < kNumOpts; i++ {
-		z.optimum[i] = &optimal{}
+// init makes z ready to encode a new stream to w. The tables allocated for a
+// previous stream, with the same parameters, are reused.
+func (z *encoder) init(w io.Writer) {
+	if z.re == nil {
+		z.re = newRangeEncoder(w)
+	} else {
+		z.re.init(w)
 	}
+	z.re.pricing = z.pricing
 
-	z.isMatch = initBitModels(kNumStates << kNumPosStatesBitsMax)
-	z.isRep = initBitModels(kNumStates)
-	z.isRepG0 = initBitModels(kNumStates)
-	z.isRepG1 = initBitModels(kNumStates)
-	z.isRepG2 = initBitModels(kNumStates)
-	z.isRep0Long = initBitModels(kNumStates << kNumPosStatesBitsMax)
+	numPosStates := uint32(1) << z.cl.posStateBits
+	if z.mf == nil {
+		z.mf, z.iw = newMatchFinder(z.cl.matchFinder, z.cl.dictSize, kNumOpts, z.cl.fastBytes, kMatchMaxLen+1, z.cl.matchCycles)
 
-	z.posSlotCoders = make([]*rangeBitTreeCoder, kNumLenToPosStates)
-	for i := 0; i < kNumLenToPosStates; i++ {
-		z.posSlotCoders[i] = newRangeBitTreeCoder(kNumPosSlotBits)
-	}
+		z.optimum = make([]*optimal, kNumOpts)
+		for i := 0; i < kNumOpts; i++ {
+			z.optimum[i] = &optimal{}
+		}
 
-	z.posCoders = initBitModels(kNumFullDistances - kEndPosModelIndex)
-	z.posAlignCoder = newRangeBitTreeCoder(kNumAlignBits)
+		z.posSlotCoders = make([]*rangeBitTreeCoder, kNumLenToPosStates)
+		for i := 0; i < kNumLenToPosStates; i++ {
+			z.posSlotCoders[i] = newRangeBitTreeCoder(kNumPosSlotBits)
+		}
+		z.posAlignCoder = newRangeBitTreeCoder(kNumAlignBits)
 
-	z.lenCoder = newLenPriceTableCoder(z.cl.fastBytes+1-kMatchMinLen, 1<<z.cl.posStateBits)
-	z.repMatchLenCoder = newLenPriceTableCoder(z.cl.fastBytes+1-kMatchMinLen, 1<<z.cl.posStateBits)
+		z.lenCoder = newLenPriceTableCoder(z.cl.fastBytes+1-kMatchMinLen, numPosStates)
+		z.repMatchLenCoder = newLenPriceTableCoder(z.cl.fastBytes+1-kMatchMinLen, numPosStates)
 
-	z.litCoder = newLitCoder(z.cl.litPosStateBits, z.cl.litContextBits)
+		z.litCoder = newLitCoder(z.cl.litPosStateBits, z.cl.litContextBits)
 
-	z.matchDistances = make([]uint32, kMatchMaxLen*2+2)
+		z.matchDistances = make([]uint32, kMatchMaxLen*2+2)
+
+		z.posSlotPrices = make([]uint32, 1<<(kNumPosSlotBits+kNumLenToPosStatesBits))
+		z.distancesPrices = make([]uint32, kNumFullDistances<<kNumLenToPosStatesBits)
+		z.tempPrices = make([]uint32, kNumFullDistances)
+		z.alignPrices = make([]uint32, kAlignTableSize)
+
+		z.repDistances = make([]uint32, kNumRepDistances)
+		z.reps = make([]uint32, kNumRepDistances)
+		z.repLens = make([]uint32, kNumRepDistances)
+	} else {
+		z.mf.reset()
+		for i := 0; i < kNumLenToPosStates; i++ {
+			z.posSlotCoders[i].reset()
+		}
+		z.posAlignCoder.reset()
+		z.lenCoder.reset(numPosStates)
+		z.repMatchLenCoder.reset(numPosStates)
+		z.litCoder.reset(z.cl.litPosStateBits, z.cl.litContextBits)
+	}
+
+	z.isMatch = reuseBitModels(z.isMatch, kNumStates<<kNumPosStatesBitsMax)
+	z.isRep = reuseBitModels(z.isRep, kNumStates)
+	z.isRepG0 = reuseBitModels(z.isRepG0, kNumStates)
+	z.isRepG1 = reuseBitModels(z.isRepG1, kNumStates)
+	z.isRepG2 = reuseBitModels(z.isRepG2, kNumStates)
+	z.isRep0Long = reuseBitModels(z.isRep0Long, kNumStates<<kNumPosStatesBitsMax)
+	z.posCoders = reuseBitModels(z.posCoders, kNumFullDistances-kEndPosModelIndex)
 
 	z.additionalOffset = 0
 
@@ -1077,11 +1419,7 @@ func (z *encoder) encoder(r io.Reader, w io.Writer, size int64, level int) (err
 
 	z.longestMatchFound = false
 
-	z.posSlotPrices = make([]uint32, 1<<(kNumPosSlotBits+kNumLenToPosStatesBits))
-	z.distancesPrices = make([]uint32, kNumFullDistances<<kNumLenToPosStatesBits)
-	z.alignPrices = make([]uint32, kAlignTableSize)
-
-	z.posStateMask = 1<<z.cl.posStateBits - 1
+	z.posStateMask = numPosStates - 1
 
 	z.nowPos = 0
 	z.finished = false
@@ -1089,29 +1427,305 @@ func (z *encoder) encoder(r io.Reader, w io.Writer, size int64, level int) (err
 	z.state = 0
 	z.prevByte = 0
 
-	z.repDistances = make([]uint32, kNumRepDistances)
 	for i := 0; i < kNumRepDistances; i++ {
 		z.repDistances[i] = 0
 	}
 
 	z.matchPriceCount = 0
 
-	z.reps = make([]uint32, kNumRepDistances)
-	z.repLens = make([]uint32, kNumRepDistances)
-
 	z.fillDistancesPrices()
 	z.fillAlignPrices()
+	z.stats = Stats{}
+
+	if z.presetSize > 0 {
+		z.loadPreset()
+	}
+}
+
+// span returns the number of bytes the dictionary may have to hold to encode
+// size bytes, -1 if unknown: those of the preset dictionary and of the data.
+func (z *encoder) span(size int64) int64 {
+	if size < 0 {
+		return -1
+	}
+	return z.presetSize + size
+}
+
+// loadPreset puts the last bytes of the preset dictionary, as many as the
+// dictionary holds, in the window and the match finder, as if they had been
+// encoded just before the data.
+func (z *encoder) loadPreset() {
+	off := z.presetSize - int64(z.cl.dictSize)
+	if off < 0 {
+		off = 0
+	}
+	for off < z.presetSize {
+		n := z.iw.readAt(z.preset, off, z.presetSize-off)
+		z.mf.skip(uint32(n))
+		off += int64(n)
+	}
+	z.prevByte = z.iw.getIndexByte(-1)
+}
+
+// Stats counts the symbols a Writer encoded, see Writer.Stats, and gives their
+// cost in bits if WriterOptions.PriceStats is set, as estimated from the
+// probabilities they were encoded with, the same way the encoder prices its
+// choices. The estimates run a few percent above the actual size. The header,
+// the end marker and the flushing of the range coder are not counted.
+type Stats struct {
+	Literals        int64                   // literals coded on their own
+	MatchedLiterals int64                   // literals coded against the byte at rep0, after a match
+	Matches         int64                   // matches at a new distance
+	Reps            [kNumRepDistances]int64 // matches at rep0-rep3, short reps excluded
+	ShortReps       int64                   // one-byte matches at rep0
+
+	// MatchLens is the histogram of the lengths of matches and reps, short
+	// reps at 1. DistSlots is the histogram of the distance slots of
+	// matches: slots 0 to 3 hold distances 1 to 4, and slot s above holds
+	// the distances of s/2 bits or so.
+	MatchLens [kMatchMaxLen + 1]int64
+	DistSlots [1 << kNumPosSlotBits]int64
+
+	LiteralBits        float64
+	MatchedLiteralBits float64
+	MatchBits          float64
+	RepBits            [kNumRepDistances]float64
+	ShortRepBits       float64
+}
+
+// priceBits converts a price to bits.
+func priceBits(price uint64) float64 {
+	return float64(price) / (1 << kNumBitPriceShiftBits)
+}
+
+// A Writer is an io.WriteCloser compressing the data written to it. Encoding
+// happens inside Write and Close, in the caller's goroutine: Write encodes as
+// much of the data as it can and buffers the rest, which it needs as lookahead;
+// Close encodes whatever is left and terminates the stream.
+//
+type Writer struct {
+	w         io.Writer
+	z         encoder
+	opts      WriterOptions
+	optsErr   error        // invalid options, reported by every Write and Close
+	header    bool         // write the .lzma header before the compressed data
+	patch     bool         // patch the size into the header on Close, see NewWriterSeeker
+	headerPos int64        // offset of the header in w, if patch
+	refHeader []byte       // patch header written before the header, see NewWriterPatch
+	dict      bytes.Reader // preset dictionary, see NewWriterDict
+	n         int64        // number of bytes written so far
+	started   bool
+	closed    bool
+	err       error
+}
+
+func newWriter(w io.Writer, opts *WriterOptions, header bool) *Writer {
+	zw := &Writer{w: w, opts: *opts, header: header}
+	zw.optsErr = opts.Validate()
+	zw.err = zw.optsErr
+	return zw
+}
+
+func (zw *Writer) start() {
+	zw.z.setup(&zw.opts, zw.patch)
+	if zw.refHeader != nil {
+		n, err := zw.w.Write(zw.refHeader)
+		if err != nil {
+			throw(err)
+		}
+		if n != len(zw.refHeader) {
+			throw(io.ErrShortWrite)
+		}
+	}
+	if zw.patch {
+		ws, ok := zw.w.(io.WriteSeeker)
+		if !ok {
+			throw(ErrNotSeeker)
+		}
+		pos, err := ws.Seek(0, io.SeekCurrent)
+		if err != nil {
+			throw(err)
+		}
+		zw.headerPos = pos
+	}
+	if zw.header {
+		zw.z.writeHeader(zw.w)
+	}
+	// do not move before writeHeader
+	zw.z.init(zw.w)
+	zw.started = true
+}
+
+func (zw *Writer) write(p []byte) (n int, err error) {
+	defer handlePanics(&err)
+
+	if !zw.started {
+		zw.start()
+	}
+	for len(p) > 0 {
+		m := zw.z.iw.write(p)
+		n += m
+		p = p[m:]
+		for !zw.z.needInput() {
+			zw.z.codeOneBlock()
+		}
+	}
+	return
+}
+
+// Write compresses p. Errors of the underlying io.Writer are reported as soon
+// as they occur, by the Write call or the Close call that ran into them. Data
+// beyond the size declared in the header is not written, and reported as an
+// error matching ErrSizeMismatch.
+func (zw *Writer) Write(p []byte) (n int, err error) {
+	if zw.closed {
+		return 0, ErrClosed
+	}
+	if zw.err != nil {
+		return 0, zw.err
+	}
+	tooLong := false
+	if size := zw.opts.Size; size >= 0 && int64(len(p)) > size-zw.n {
+		p, tooLong = p[:size-zw.n], true
+	}
+	n, zw.err = zw.write(p)
+	zw.n += int64(n)
+	if zw.err == nil && tooLong {
+		zw.err = &sizeError{size: zw.opts.Size, more: true}
+	}
+	return n, zw.err
+}
+
+func (zw *Writer) finish() (err error) {
+	defer handlePanics(&err)
 
-	z.doEncode()
+	if !zw.started {
+		zw.start()
+	}
+	if zw.opts.Size >= 0 && zw.n < zw.opts.Size {
+		throw(&sizeError{size: zw.opts.Size, n: zw.n})
+	}
+	zw.z.iw.finish()
+	for !zw.z.finished {
+		zw.z.codeOneBlock()
+	}
+	if zw.patch {
+		zw.patchSize()
+	}
 	return
 }
 
+// patchSize rewrites the header with the size of the data, and goes back to
+// the end of the stream.
+func (zw *Writer) patchSize() {
+	ws := zw.w.(io.WriteSeeker)
+	end, err := ws.Seek(0, io.SeekCurrent)
+	if err != nil {
+		throw(err)
+	}
+	if _, err = ws.Seek(zw.headerPos, io.SeekStart); err != nil {
+		throw(err)
+	}
+	zw.z.size = zw.z.nowPos
+	zw.z.writeHeader(ws)
+	if _, err = ws.Seek(end, io.SeekStart); err != nil {
+		throw(err)
+	}
+}
+
+// Close encodes the data still buffered and flushes the stream. It does not
+// close the underlying io.Writer. If less data than the size declared in the
+// header was written, the stream is not terminated and an error matching
+// ErrSizeMismatch is returned.
+func (zw *Writer) Close() error {
+	if zw.closed {
+		return zw.err
+	}
+	zw.closed = true
+	if zw.err != nil {
+		return zw.err
+	}
+	zw.err = zw.finish()
+	return zw.err
+}
+
+// Stats returns the statistics of the stream being written. Data is counted
+// once encoded, which Write may defer until more data or Close comes, so that
+// the statistics are complete after Close only.
+func (zw *Writer) Stats() Stats {
+	if !zw.started {
+		return Stats{}
+	}
+	return zw.z.stats
+}
+
+// Reset discards the Writer's state and makes it equivalent to the result of
+// its original constructor, but writing to w instead. The dictionary, the
+// match finder and the probability tables are reused: a Writer kept for many
+// streams does not allocate once warmed up.
+func (zw *Writer) Reset(w io.Writer) {
+	zw.w = w
+	zw.n = 0
+	zw.started = false
+	zw.closed = false
+	zw.err = zw.optsErr
+}
+
+// NewWriterOptions is like NewWriterSizeLevel, but the encoder is configured
+// by opts instead of a compression level. The size written in the header is
+// opts.Size. An error matching ErrInvalidOption is returned if opts is not
+// valid.
+//
+func NewWriterOptions(w io.Writer, opts WriterOptions) (*Writer, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	return newWriter(w, &opts, true), nil
+}
+
+// NewWriterDict is like NewWriterOptions, but the encoder starts with the
+// preset dictionary dict, as if it had just compressed it: data resembling
+// dict compresses better, small data above all. Only the last opts.DictSize
+// bytes of dict matter. dict is not written to w: the stream must be decoded
+// with the same dict, see NewReaderDict. It is not copied either, and must not
+// be modified while the Writer is in use.
+//
+func NewWriterDict(w io.Writer, opts WriterOptions, dict []byte) (*Writer, error) {
+	zw, err := NewWriterOptions(w, opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(dict) > int(opts.DictSize) {
+		dict = dict[len(dict)-int(opts.DictSize):]
+	}
+	zw.dict.Reset(dict)
+	zw.z.preset, zw.z.presetSize = &zw.dict, int64(len(dict))
+	return zw, nil
+}
+
+// ErrNotSeeker is returned by a Writer from NewWriterSeeker reset to a
+// destination that cannot seek, on its first Write or Close.
+var ErrNotSeeker = errors.New("lzma: size patching needs an io.WriteSeeker")
+
+// NewWriterSeeker is like NewWriterOptions, but if opts.Size is -1, the header
+// is written with an unknown size, which Close replaces with the number of
+// bytes written, seeking back to the header; the stream then needs no end
+// marker and has none, whatever opts.EndMarker. The Writer must be reset to
+// io.WriteSeekers only.
+//
+func NewWriterSeeker(w io.WriteSeeker, opts WriterOptions) (*Writer, error) {
+	if err := opts.validate(true); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, opts: opts, header: true, patch: opts.Size == -1}, nil
+}
+
 // NewWriterSizeLevel writes to the given Writer the compressed version of
 // data written to the returned WriteCloser. It is the caller's responsibility
 // to call Close on the WriteCloser when done. size is the actual size of
 // uncompressed data that's going to be written to WriteCloser. If size is
 // unknown, use -1 instead. level is any integer value between BestSpeed and
-// BestCompression.
+// BestCompression. The WriteCloser is a *Writer.
 //
 // size and level (the lzma header) are written to w before any compressed data.
 // If size is -1, last bytes are encoded in a different way to mark the end of
@@ -1122,13 +1736,40 @@ func NewWriterSizeLevel(w io.Writer, size int64, level int) io.WriteCloser {
 	// stores the size before any compressed data. gzip appends the size and
 	// the checksum at the end of the stream, thus it can compute the size
 	// while reading data from pipe.
-	var z encoder
-	pr, pw := syncPipe()
-	go func() {
-		err := z.encoder(pr, w, size, level)
-		pr.CloseWithError(err)
-	}()
-	return pw
+	opts, err := LevelOptions(level)
+	opts.Size = size
+	opts.EndMarker = size == -1
+	zw := newWriter(w, &opts, true)
+	if err != nil {
+		zw.optsErr, zw.err = err, err
+	}
+	return zw
+}
+
+// NewWriterRaw is like NewWriterSizeLevel, but no header is written to w: the
+// compressed data starts right away, as in the LZMA entries of zip files. The
+// decoder must learn the properties of the stream by other means, see
+// LevelProps. If eos is true, the end of the stream is marked as it is when
+// size is -1; eos must be true if size is -1. The WriteCloser is a *Writer.
+//
+func NewWriterRaw(w io.Writer, size int64, level int, eos bool) io.WriteCloser {
+	opts, err := LevelOptions(level)
+	opts.Size = size
+	opts.EndMarker = eos
+	zw := newWriter(w, &opts, false)
+	if err != nil {
+		zw.optsErr, zw.err = err, err
+	}
+	return zw
+}
+
+// LevelProps returns the properties of the streams written with the
+// compression level level. The streams of known size may use a smaller
+// dictionary, but decode all the same with these properties.
+//
+func LevelProps(level int) (Props, error) {
+	opts, err := LevelOptions(level)
+	return opts.Props, err
 }
 
 // Same as NewWriterSizeLevel(w, -1, level).
@@ -1148,3 +1789,62 @@ func NewWriterSize(w io.Writer, size int64) io.WriteCloser {
 func NewWriter(w io.Writer) io.WriteCloser {
 	return NewWriterSizeLevel(w, -1, DefaultCompression)
 }
+
+// Compress writes to dst the compressed version of src, read until io.EOF,
+// and returns the number of bytes read. The stream is encoded as by a Writer
+// configured by opts, but for its size: if src tells how many bytes it has
+// left, the header holds that size and the stream has no end marker, else the
+// size is unknown and the stream has an end marker. opts.Size and
+// opts.EndMarker are ignored.
+//
+// The size is taken from the Len method of src, such as that of a
+// *bytes.Reader, *bytes.Buffer or *strings.Reader, from its Size method, as
+// that of an *io.SectionReader, or from the Stat method of a regular
+// *os.File. In the last two cases, src must also be an io.Seeker, to tell
+// where reading starts. If src then holds more or less data than it told,
+// Compress fails with an error matching ErrSizeMismatch.
+//
+func Compress(dst io.Writer, src io.Reader, opts WriterOptions) (n int64, err error) {
+	opts.Size = sizeLeft(src)
+	opts.EndMarker = opts.Size == -1
+	zw, err := NewWriterOptions(dst, opts)
+	if err != nil {
+		return 0, err
+	}
+	if n, err = io.Copy(zw, src); err != nil {
+		return
+	}
+	return n, zw.Close()
+}
+
+// sizeLeft returns the number of bytes r has left to read, -1 if r does not
+// tell, see Compress.
+func sizeLeft(r io.Reader) int64 {
+	switch v := r.(type) {
+	case interface{ Len() int }:
+		return int64(v.Len())
+	case interface{ Size() int64 }:
+		return sizeFrom(r, v.Size())
+	case interface{ Stat() (os.FileInfo, error) }:
+		fi, err := v.Stat()
+		if err != nil || !fi.Mode().IsRegular() {
+			return -1
+		}
+		return sizeFrom(r, fi.Size())
+	}
+	return -1
+}
+
+// sizeFrom returns the number of bytes left in r, a reader of size bytes, if
+// r is an io.Seeker, -1 otherwise.
+func sizeFrom(r io.Reader, size int64) int64 {
+	s, ok := r.(io.Seeker)
+	if !ok {
+		return -1
+	}
+	pos, err := s.Seek(0, io.SeekCurrent)
+	if err != nil || pos > size {
+		return -1
+	}
+	return size - pos
+}
@@ -5,11 +5,17 @@
 package lzma
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
 	"io"
 	"io/ioutil"
 	"log"
+	"os"
+	"strings"
+	"sync"
 	"testing"
+	"unsafe"
 )
 
 func pipe(t *testing.T, efunc func(io.WriteCloser), dfunc func(io.ReadCloser), size int64) {
@@ -155,3 +161,777 @@ func BenchmarkEncoder(b *testing.B) {
 		log.Fatalf("%s: got %d-byte %q, want %d-byte %q", bench.descr, len(buf.Bytes()), buf.String(), len(bench.lzma), string(bench.lzma))
 	}
 }
+
+// BenchmarkEncoderMode compares the speed and the compression ratio of the
+// two modes, with the other options of the default level.
+func BenchmarkEncoderMode(b *testing.B) {
+	for _, mode := range []struct {
+		name string
+		mode Mode
+	}{
+		{"fast", ModeFast},
+		{"normal", ModeNormal},
+	} {
+		b.Run(mode.name, func(b *testing.B) {
+			opts, _ := LevelOptions(DefaultCompression)
+			opts.Mode = mode.mode
+			buf := new(bytes.Buffer)
+			w, _ := NewWriterOptions(buf, opts)
+			b.SetBytes(int64(len(bench.raw)))
+			for i := 0; i < b.N; i++ {
+				buf.Reset()
+				w.Reset(buf)
+				w.Write(bench.raw)
+				if err := w.Close(); err != nil {
+					b.Fatalf("%v", err)
+				}
+			}
+			b.ReportMetric(float64(len(bench.raw))/float64(buf.Len()), "ratio")
+		})
+	}
+}
+
+func TestWriterRaw(t *testing.T) {
+	payload := []byte("lzmalzmalzma, hello lzma world\n")
+	p, err := LevelProps(3)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, tc := range []struct {
+		size     int64 // size given to the encoder
+		readSize int64 // size given to the decoder
+		eos      bool
+	}{
+		{-1, -1, true},
+		{int64(len(payload)), int64(len(payload)), false},
+		{int64(len(payload)), int64(len(payload)), true},
+		{int64(len(payload)), -1, true},
+		{int64(len(payload)), -1, false}, // decoding stops at EOF
+	} {
+		b := new(bytes.Buffer)
+		w := NewWriterRaw(b, tc.size, 3, tc.eos)
+		if _, err := w.Write(payload); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("%v", err)
+		}
+		r := NewReaderRaw(b, p, tc.readSize, tc.eos)
+		res, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("size %d/%d, eos %v: %v", tc.size, tc.readSize, tc.eos, err)
+		}
+		if !bytes.Equal(res, payload) {
+			t.Errorf("size %d/%d, eos %v: got %q, want %q", tc.size, tc.readSize, tc.eos, res, payload)
+		}
+	}
+}
+
+// The output must not depend on how the input is split between calls to Write,
+// including when the input is larger than the dictionary.
+func TestWriterChunks(t *testing.T) {
+	var want []byte
+	for _, chunk := range []int{len(bench.raw), 1, 1000, 65536} {
+		b := new(bytes.Buffer)
+		w := NewWriterLevel(b, 1)
+		for p := bench.raw; len(p) > 0; {
+			n := chunk
+			if n > len(p) {
+				n = len(p)
+			}
+			if _, err := w.Write(p[:n]); err != nil {
+				t.Fatalf("%v", err)
+			}
+			p = p[n:]
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if want == nil {
+			want = b.Bytes()
+			res, err := ioutil.ReadAll(NewReader(bytes.NewReader(want)))
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if !bytes.Equal(res, bench.raw) {
+				t.Fatalf("round trip: got %d bytes, want %d bytes", len(res), len(bench.raw))
+			}
+		} else if !bytes.Equal(b.Bytes(), want) {
+			t.Errorf("%d-byte writes: got %d compressed bytes, want %d", chunk, b.Len(), len(want))
+		}
+	}
+}
+
+type errWriter struct {
+	err error
+}
+
+func (e *errWriter) Write(p []byte) (int, error) {
+	return 0, e.err
+}
+
+func TestWriterError(t *testing.T) {
+	want := errors.New("destination error")
+	w := NewWriter(&errWriter{want})
+	var err error
+	for i := 0; i < 100 && err == nil; i++ {
+		_, err = w.Write(bench.raw)
+	}
+	if err != want {
+		t.Errorf("Write: got error %v, want %v", err, want)
+	}
+	if err = w.Close(); err != want {
+		t.Errorf("Close: got error %v, want %v", err, want)
+	}
+}
+
+func TestWriterReset(t *testing.T) {
+	b := new(bytes.Buffer)
+	zw := NewWriterSizeLevel(nil, -1, 3).(*Writer)
+	for i := 0; i < 3; i++ {
+		for _, tt := range lzmaTests {
+			if tt.err != nil || tt.level != 3 || tt.size == true {
+				continue
+			}
+			b.Reset()
+			zw.Reset(b)
+			if _, err := zw.Write([]byte(tt.raw)); err != nil {
+				t.Fatalf("%v", err)
+			}
+			if err := zw.Close(); err != nil {
+				t.Fatalf("%v", err)
+			}
+			if !bytes.Equal(b.Bytes(), tt.lzma) {
+				t.Errorf("%s: got %d-byte %q, want %d-byte %q", tt.descr, b.Len(), b.String(), len(tt.lzma), string(tt.lzma))
+			}
+		}
+	}
+}
+
+func TestWriterResetAllocs(t *testing.T) {
+	b := new(bytes.Buffer)
+	zw := NewWriterLevel(b, 1).(*Writer)
+	allocs := testing.AllocsPerRun(5, func() {
+		b.Reset()
+		zw.Reset(b)
+		if _, err := zw.Write(bench.raw); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("%v", err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("%v allocations per stream, want 0", allocs)
+	}
+}
+
+// TestWriterConcurrent is meant to be run with -race: encoders running in
+// different goroutines must not share any mutable state.
+func TestWriterConcurrent(t *testing.T) {
+	data := bench.raw[:50000]
+	var want []byte
+	for i := 0; i < 2; i++ { // the first round initializes the tables
+		out := make([][]byte, 8)
+		var wg sync.WaitGroup
+		for j := range out {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+				b := new(bytes.Buffer)
+				w := NewWriterSizeLevel(b, int64(len(data)), j%BestCompression+1)
+				w.Write(data)
+				w.Close()
+				out[j] = b.Bytes()
+			}(j)
+		}
+		wg.Wait()
+		for j, b := range out {
+			res, err := ioutil.ReadAll(NewReader(bytes.NewReader(b)))
+			if err != nil || !bytes.Equal(res, data) {
+				t.Errorf("round %d, encoder %d: got %d bytes, %v", i, j, len(res), err)
+			}
+		}
+		if want != nil && !bytes.Equal(out[0], want) {
+			t.Errorf("round %d: output differs from the first round", i)
+		}
+		want = out[0]
+	}
+}
+
+func TestWriterInvalidOption(t *testing.T) {
+	for _, w := range []io.WriteCloser{
+		NewWriterLevel(ioutil.Discard, BestCompression+1),
+		NewWriterSize(ioutil.Discard, -2),
+		NewWriterRaw(ioutil.Discard, -1, DefaultCompression, false),
+	} {
+		_, err := w.Write([]byte("hello"))
+		if !errors.Is(err, ErrInvalidOption) {
+			t.Errorf("got error %v, want %v", err, ErrInvalidOption)
+		}
+	}
+}
+
+func TestWriterOptions(t *testing.T) {
+	// the options of a level give the output of the level
+	for _, tt := range lzmaTests {
+		if tt.err != nil {
+			continue
+		}
+		opts, err := LevelOptions(tt.level)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if tt.size {
+			opts.Size = int64(len(tt.raw))
+			opts.EndMarker = false
+		}
+		b := new(bytes.Buffer)
+		w, err := NewWriterOptions(b, opts)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.descr, err)
+		}
+		w.Write([]byte(tt.raw))
+		w.Close()
+		if !bytes.Equal(b.Bytes(), tt.lzma) {
+			t.Errorf("%s: output differs from level %d", tt.descr, tt.level)
+		}
+	}
+
+	data := bench.raw[:100000]
+	base, _ := LevelOptions(DefaultCompression)
+	for _, change := range []func(*WriterOptions){
+		func(o *WriterOptions) { o.LC, o.LP, o.PB = 0, 2, 2 },
+		func(o *WriterOptions) { o.LC, o.LP, o.PB = 8, 4, 4 },
+		func(o *WriterOptions) { o.DictSize = 100000 },
+		func(o *WriterOptions) { o.DictSize = MinDictSize },
+		func(o *WriterOptions) { o.NiceLen = MinNiceLen },
+		func(o *WriterOptions) { o.NiceLen = MaxNiceLen },
+		func(o *WriterOptions) { o.MatchFinder = "bt2" },
+		func(o *WriterOptions) { o.Depth = 1 },
+		func(o *WriterOptions) { o.Mode = ModeFast },
+		func(o *WriterOptions) { o.Mode, o.MatchFinder = ModeFast, "bt2" },
+		func(o *WriterOptions) { o.Mode, o.NiceLen = ModeFast, MinNiceLen },
+		func(o *WriterOptions) { o.Size = int64(len(data)) },
+		func(o *WriterOptions) { o.Size, o.EndMarker = int64(len(data)), false },
+	} {
+		opts := base
+		change(&opts)
+		b := new(bytes.Buffer)
+		w, err := NewWriterOptions(b, opts)
+		if err != nil {
+			t.Fatalf("%+v: %v", opts, err)
+		}
+		w.Write(data)
+		if err = w.Close(); err != nil {
+			t.Fatalf("%+v: %v", opts, err)
+		}
+		r := NewReader(b).(*Reader)
+		res, err := ioutil.ReadAll(r)
+		if err != nil || !bytes.Equal(res, data) {
+			t.Errorf("%+v: got %d bytes, %v", opts, len(res), err)
+		}
+		want := opts.Props
+		if opts.Size >= 0 && want.DictSize > 1<<17 {
+			want.DictSize = 1 << 17 // the smallest valid size holding the data
+		}
+		if h, _ := r.Header(); h.Props != want {
+			t.Errorf("%+v: got props %+v", opts, h.Props)
+		}
+	}
+
+	for _, change := range []func(*WriterOptions){
+		func(o *WriterOptions) { o.DictSize = MinDictSize - 1 },
+		func(o *WriterOptions) { o.DictSize = MaxDictSize + 1 },
+		func(o *WriterOptions) { o.NiceLen = MinNiceLen - 1 },
+		func(o *WriterOptions) { o.NiceLen = MaxNiceLen + 1 },
+		func(o *WriterOptions) { o.LC = 9 },
+		func(o *WriterOptions) { o.LP = 5 },
+		func(o *WriterOptions) { o.PB = 5 },
+		func(o *WriterOptions) { o.MatchFinder = "hc3" },
+		func(o *WriterOptions) { o.Mode = ModeFast + 1 },
+		func(o *WriterOptions) { o.Size = -2 },
+		func(o *WriterOptions) { o.EndMarker = false },
+	} {
+		opts := base
+		change(&opts)
+		if _, err := NewWriterOptions(ioutil.Discard, opts); !errors.Is(err, ErrInvalidOption) {
+			t.Errorf("%+v: got error %v, want %v", opts, err, ErrInvalidOption)
+		}
+	}
+}
+
+func TestWriterMatchFinders(t *testing.T) {
+	data := bench.raw[:200000]
+	for mf := range matchFinders {
+		for _, mode := range []Mode{ModeNormal, ModeFast} {
+			opts, _ := LevelOptions(DefaultCompression)
+			opts.MatchFinder, opts.Mode = mf, mode
+			opts.DictSize = MinDictSize // the cyclic buffer wraps around
+			b := new(bytes.Buffer)
+			w, err := NewWriterOptions(b, opts)
+			if err != nil {
+				t.Fatalf("%s: %v", mf, err)
+			}
+			// short streams first, for the matches near the end of the input
+			for n := 0; n <= 8; n++ {
+				b.Reset()
+				w.Reset(b)
+				w.Write(data[:n])
+				w.Close()
+				res, err := ioutil.ReadAll(NewReader(b))
+				if err != nil || !bytes.Equal(res, data[:n]) {
+					t.Errorf("%s, mode %d, %d bytes: got %q, %v", mf, mode, n, res, err)
+				}
+			}
+			b.Reset()
+			w.Reset(b)
+			w.Write(data)
+			if err = w.Close(); err != nil {
+				t.Fatalf("%s: %v", mf, err)
+			}
+			size := b.Len()
+			res, err := ioutil.ReadAll(NewReader(b))
+			if err != nil || !bytes.Equal(res, data) {
+				t.Errorf("%s, mode %d: got %d bytes, %v", mf, mode, len(res), err)
+			}
+			if size >= len(data)/2 {
+				t.Errorf("%s, mode %d: compressed to %d bytes", mf, mode, size)
+			}
+		}
+	}
+}
+
+func TestWriterDepth(t *testing.T) {
+	if opts, _ := LevelOptions(BestSpeed); opts.Depth == 0 {
+		t.Errorf("level %d: got depth 0, want an explicit depth", BestSpeed)
+	}
+	if opts, _ := LevelOptions(BestCompression); opts.Depth != 0 {
+		t.Errorf("level %d: got depth %d, want 0", BestCompression, opts.Depth)
+	}
+
+	data := bench.raw[:100000]
+	for _, mf := range []string{"bt4", "hc4"} {
+		size := func(depth uint32) int {
+			opts, _ := LevelOptions(DefaultCompression)
+			opts.MatchFinder, opts.Depth = mf, depth
+			b := new(bytes.Buffer)
+			w, err := NewWriterOptions(b, opts)
+			if err != nil {
+				t.Fatalf("%s, depth %d: %v", mf, depth, err)
+			}
+			w.Write(data)
+			if err = w.Close(); err != nil {
+				t.Fatalf("%s, depth %d: %v", mf, depth, err)
+			}
+			n := b.Len()
+			res, err := ioutil.ReadAll(NewReader(b))
+			if err != nil || !bytes.Equal(res, data) {
+				t.Errorf("%s, depth %d: got %d bytes, %v", mf, depth, len(res), err)
+			}
+			return n
+		}
+		shallow, deep := size(1), size(1000)
+		if shallow <= deep {
+			t.Errorf("%s: got %d bytes at depth 1, %d at depth 1000", mf, shallow, deep)
+		}
+	}
+}
+
+// encoderRounding is how much more than EncoderMemoryUsage the allocator may
+// take, rounding the allocations up to their size class: 4 bytes for each of
+// the kNumOpts optimal items, and up to a page for each large buffer.
+const encoderRounding = 40 << 10
+
+func TestEncoderMemoryUsage(t *testing.T) {
+	data := []byte{0}
+	for mf := range matchFinders {
+		for _, level := range []int{BestSpeed, DefaultCompression} {
+			opts, _ := LevelOptions(level)
+			opts.MatchFinder = mf
+			want, err := EncoderMemoryUsage(opts)
+			if err != nil {
+				t.Fatalf("%s, level %d: %v", mf, level, err)
+			}
+			got := allocated(func() {
+				w, _ := NewWriterOptions(ioutil.Discard, opts)
+				w.Write(data)
+				w.Close()
+			})
+			if got < want || got > want+encoderRounding {
+				t.Errorf("%s, level %d: allocated %d bytes, computed %d", mf, level, got, want)
+			}
+		}
+	}
+
+	// no output buffer for a *bufio.Writer
+	opts, _ := LevelOptions(BestSpeed)
+	want, _ := EncoderMemoryUsage(opts)
+	bw := bufio.NewWriter(ioutil.Discard)
+	got := allocated(func() {
+		w, _ := NewWriterOptions(bw, opts)
+		w.Write(data)
+		w.Close()
+	})
+	if want -= ioBufSize + int64(unsafe.Sizeof(bufio.Writer{})); got < want || got > want+encoderRounding {
+		t.Errorf("allocated %d bytes, want %d", got, want)
+	}
+
+	opts.MatchFinder = "hc3"
+	if _, err := EncoderMemoryUsage(opts); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("got error %v, want %v", err, ErrInvalidOption)
+	}
+}
+
+func TestWriterKnownSize(t *testing.T) {
+	for _, tt := range []struct {
+		dictSize uint32
+		size     int64
+		want     uint32
+	}{
+		{1 << 27, -1, 1 << 27},
+		{1 << 27, 0, MinDictSize},
+		{1 << 27, MinDictSize, MinDictSize},
+		{1 << 27, MinDictSize + 1, 6 << 10},
+		{1 << 27, 10000, 12 << 10},
+		{1 << 27, 12 << 10, 12 << 10},
+		{1 << 27, 12<<10 + 1, 16 << 10},
+		{1 << 27, 1 << 27, 1 << 27},
+		{1 << 27, 1<<27 + 1, 1 << 27},
+		{100000, 99000, 100000},
+		{MinDictSize, 1 << 20, MinDictSize},
+	} {
+		if got := dictSizeFor(tt.dictSize, tt.size); got != tt.want {
+			t.Errorf("dictSizeFor(%d, %d) = %d, want %d", tt.dictSize, tt.size, got, tt.want)
+		}
+	}
+
+	// a 10 KB file at the best compression
+	data := bench.raw[:10000]
+	b := new(bytes.Buffer)
+	opts, _ := LevelOptions(BestCompression)
+	opts.Size = int64(len(data))
+	mem, _ := EncoderMemoryUsage(opts)
+	if got := allocated(func() {
+		w := NewWriterSizeLevel(b, int64(len(data)), BestCompression)
+		w.Write(data)
+		w.Close()
+	}); got > mem+64<<10 || mem > 4<<20 {
+		t.Errorf("allocated %d bytes, computed %d", got, mem)
+	}
+	h, err := ParseHeader(b.Bytes())
+	if err != nil || h.DictSize != 12<<10 {
+		t.Errorf("got header %+v, %v", h, err)
+	}
+	res, err := ioutil.ReadAll(NewReader(b))
+	if err != nil || !bytes.Equal(res, data) {
+		t.Errorf("got %d bytes, %v", len(res), err)
+	}
+}
+
+func TestWriterSeeker(t *testing.T) {
+	f, err := ioutil.TempFile("", "lzma")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	data := bench.raw[:100000]
+	opts, _ := LevelOptions(DefaultCompression)
+	opts.EndMarker = false // not needed, the size is patched in
+	f.WriteString("prefix")
+	w, err := NewWriterSeeker(f, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.opts != opts {
+		t.Errorf("got options %+v, want %+v", w.opts, opts)
+	}
+	w.Write(data[:1000])
+	w.Write(data[1000:])
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("suffix")
+
+	b, _ := ioutil.ReadFile(f.Name())
+	if !bytes.HasPrefix(b, []byte("prefix")) || !bytes.HasSuffix(b, []byte("suffix")) {
+		t.Fatalf("got %q...%q", b[:6], b[len(b)-6:])
+	}
+	b = b[6 : len(b)-6]
+	if h, _ := ParseHeader(b); !h.SizeKnown || h.UncompressedSize != int64(len(data)) {
+		t.Errorf("got header %+v", h)
+	}
+	res, err := ioutil.ReadAll(NewReader(bytes.NewReader(b)))
+	if err != nil || !bytes.Equal(res, data) {
+		t.Errorf("got %d bytes, %v", len(res), err)
+	}
+	eos := new(bytes.Buffer)
+	opts.EndMarker = true
+	w2, _ := NewWriterOptions(eos, opts)
+	w2.Write(data)
+	w2.Close()
+	if len(b) >= eos.Len() {
+		t.Errorf("got %d bytes, %d with an end marker", len(b), eos.Len())
+	}
+
+	w.Reset(new(bytes.Buffer))
+	if _, err = w.Write(data); err != ErrNotSeeker {
+		t.Errorf("got error %v, want %v", err, ErrNotSeeker)
+	}
+}
+
+func TestWriterSizeMismatch(t *testing.T) {
+	data := bench.raw[:1100]
+	for _, tt := range []struct {
+		writes  []int
+		n       int  // bytes accepted by the last write
+		tooMuch bool // the last write fails
+		ok      bool
+	}{
+		{[]int{1000}, 1000, false, true},
+		{[]int{400, 600}, 600, false, true},
+		{[]int{400, 600, 0}, 0, false, true},
+		{[]int{900}, 900, false, false},
+		{[]int{0}, 0, false, false},
+		{[]int{1100}, 1000, true, false},
+		{[]int{400, 700}, 600, true, false},
+		{[]int{1000, 1}, 0, true, false},
+	} {
+		b := new(bytes.Buffer)
+		w := NewWriterSize(b, 1000)
+		var n int
+		var err error
+		pos := 0
+		for _, m := range tt.writes {
+			n, err = w.Write(data[pos : pos+m])
+			pos += n
+		}
+		if n != tt.n || errors.Is(err, ErrSizeMismatch) != tt.tooMuch {
+			t.Errorf("%v: last write returned %d, %v", tt.writes, n, err)
+		}
+		err = w.Close()
+		if !tt.ok {
+			if !errors.Is(err, ErrSizeMismatch) {
+				t.Errorf("%v: got error %v, want %v", tt.writes, err, ErrSizeMismatch)
+			}
+			continue
+		}
+		res, err := ioutil.ReadAll(NewReader(b))
+		if err != nil || !bytes.Equal(res, data[:1000]) {
+			t.Errorf("%v: got %d bytes, %v", tt.writes, len(res), err)
+		}
+	}
+}
+
+func TestWriterDict(t *testing.T) {
+	dict := bench.raw[:50000]
+	data := append(append([]byte{}, bench.raw[20000:22000]...), "not in the dictionary"...)
+	for _, tt := range []struct {
+		mf       string
+		dictSize uint32
+		size     int64
+	}{
+		{"bt4", 1 << 16, -1},
+		{"bt4", 1 << 16, int64(len(data))},
+		{"hc4", 1 << 16, int64(len(data))},
+		{"bt2", MinDictSize, -1}, // only the end of dict is used
+		{"hc5", MinDictSize, int64(len(data))},
+	} {
+		opts, _ := LevelOptions(DefaultCompression)
+		opts.MatchFinder, opts.DictSize, opts.Size = tt.mf, tt.dictSize, tt.size
+		plain := new(bytes.Buffer)
+		w, _ := NewWriterOptions(plain, opts)
+		w.Write(data)
+		w.Close()
+
+		b := new(bytes.Buffer)
+		w, err := NewWriterDict(b, opts, dict)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			b.Reset()
+			w.Reset(b)
+			w.Write(data)
+			if err = w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if tt.dictSize == 1<<16 && b.Len() >= plain.Len()/4 {
+				t.Errorf("%+v: got %d bytes, %d without a dictionary", tt, b.Len(), plain.Len())
+			}
+			res, err := ioutil.ReadAll(NewReaderDict(bytes.NewReader(b.Bytes()), dict))
+			if err != nil || !bytes.Equal(res, data) {
+				t.Errorf("%+v: got %d bytes, %v", tt, len(res), err)
+			}
+			res, err = ioutil.ReadAll(NewReader(bytes.NewReader(b.Bytes())))
+			if err == nil && bytes.Equal(res, data) {
+				t.Errorf("%+v: decoded without the dictionary", tt)
+			}
+		}
+	}
+}
+
+func TestWriterStats(t *testing.T) {
+	data := bench.raw
+	for _, level := range []int{BestSpeed, DefaultCompression} {
+		b := new(bytes.Buffer)
+		opts, _ := LevelOptions(level)
+		opts.PriceStats = true
+		w, _ := NewWriterOptions(b, opts)
+		if s := w.Stats(); s.Literals != 0 {
+			t.Errorf("level %d: got %+v before writing", level, s)
+		}
+		w.Write(data)
+		w.Close()
+		s := w.Stats()
+
+		n := s.Literals + s.MatchedLiterals
+		count := s.Matches + s.ShortReps
+		for i, m := range s.Reps {
+			count += m
+			if m == 0 {
+				t.Errorf("level %d: no rep%d", level, i)
+			}
+		}
+		var lens, slots int64
+		for l, m := range s.MatchLens {
+			lens += m
+			n += int64(l) * m
+		}
+		for _, m := range s.DistSlots {
+			slots += m
+		}
+		if n != int64(len(data)) || lens != count || slots != s.Matches {
+			t.Errorf("level %d: %d bytes, %d matches, %d lengths, %d slots in %+v", level, n, count, lens, slots, s)
+		}
+		bits := s.LiteralBits + s.MatchedLiteralBits + s.MatchBits + s.ShortRepBits
+		for _, c := range s.RepBits {
+			bits += c
+		}
+		// prices are rounded up, by a few percent overall
+		if want := float64(8 * (b.Len() - lzmaHeaderSize)); bits < want || bits > want*1.1 {
+			t.Errorf("level %d: got %.0f bits, want about %.0f", level, bits, want)
+		}
+
+		w.Reset(new(bytes.Buffer))
+		if s := w.Stats(); s.Literals != 0 {
+			t.Errorf("level %d: got %+v after Reset", level, s)
+		}
+
+		// the same counts, but no bits, without PriceStats
+		opts.PriceStats = false
+		w, _ = NewWriterOptions(new(bytes.Buffer), opts)
+		w.Write(data)
+		w.Close()
+		if s2 := w.Stats(); s2.Literals != s.Literals || s2.Matches != s.Matches || s2.LiteralBits != 0 || s2.MatchBits != 0 {
+			t.Errorf("level %d: got %+v without PriceStats, %+v with", level, s2, s)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	data := bench.raw[:20000]
+	f, err := ioutil.TempFile("", "lzma")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	f.Write(data)
+	f.Seek(1000, io.SeekStart)
+
+	br := bytes.NewReader(data)
+	br.Seek(1000, io.SeekStart)
+	sr := io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data)))
+	sr.Seek(1000, io.SeekStart)
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write(data[1000:])
+		pw.Close()
+	}()
+	for _, tt := range []struct {
+		src  io.Reader
+		size int64
+	}{
+		{br, 19000},
+		{bytes.NewBuffer(data[1000:]), 19000},
+		{strings.NewReader(string(data[1000:])), 19000},
+		{sr, 19000},
+		{f, 19000},
+		{pr, -1},
+		{&oneByteReader{bytes.NewReader(data[1000:])}, -1},
+	} {
+		b := new(bytes.Buffer)
+		opts, _ := LevelOptions(BestSpeed)
+		n, err := Compress(b, tt.src, opts)
+		if n != 19000 || err != nil {
+			t.Errorf("%T: got %d, %v", tt.src, n, err)
+		}
+		if h, _ := ParseHeader(b.Bytes()); h.UncompressedSize != tt.size {
+			t.Errorf("%T: got size %d, want %d", tt.src, h.UncompressedSize, tt.size)
+		}
+		cfg := ReaderConfig{EndMarker: MarkerForbidden}
+		res, err := ioutil.ReadAll(NewReaderConfig(b, cfg))
+		if err != nil || !bytes.Equal(res, data[1000:]) {
+			t.Errorf("%T: got %d bytes, %v", tt.src, len(res), err)
+		}
+	}
+}
+
+// lenReader is an io.Reader lying about its length.
+type lenReader struct {
+	io.Reader
+	n int
+}
+
+func (r *lenReader) Len() int {
+	return r.n
+}
+
+func TestCompressSizeMismatch(t *testing.T) {
+	for _, n := range []int{999, 1001} {
+		opts, _ := LevelOptions(BestSpeed)
+		src := &lenReader{bytes.NewReader(bench.raw[:1000]), n}
+		if _, err := Compress(ioutil.Discard, src, opts); !errors.Is(err, ErrSizeMismatch) {
+			t.Errorf("Len %d: got error %v, want %v", n, err, ErrSizeMismatch)
+		}
+	}
+}
+
+func TestWriterAllProps(t *testing.T) {
+	// text followed by a table of 4-byte words, for lp to matter
+	data := append([]byte{}, bench.raw[:4096]...)
+	for i := uint32(0); i < 2048; i++ {
+		v := i * i * 7
+		data = append(data, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+	}
+	opts, _ := LevelOptions(BestSpeed)
+	opts.DictSize = MinDictSize
+	b := new(bytes.Buffer)
+	// only getOptimum prices literals and lengths by lc, lp and pb
+	for _, mode := range []Mode{ModeFast, ModeNormal} {
+		opts.Mode = mode
+		for lc := uint8(0); lc <= 8; lc++ {
+			for lp := uint8(0); lp <= 4; lp++ {
+				for pb := uint8(0); pb <= 4; pb++ {
+					opts.LC, opts.LP, opts.PB = lc, lp, pb
+					b.Reset()
+					w, err := NewWriterOptions(b, opts)
+					if err != nil {
+						t.Fatalf("mode=%d lc=%d lp=%d pb=%d: %v", mode, lc, lp, pb, err)
+					}
+					w.Write(data)
+					if err = w.Close(); err != nil {
+						t.Fatalf("mode=%d lc=%d lp=%d pb=%d: %v", mode, lc, lp, pb, err)
+					}
+					res, err := ioutil.ReadAll(NewReader(b))
+					if err != nil || !bytes.Equal(res, data) {
+						t.Errorf("mode=%d lc=%d lp=%d pb=%d: got %d bytes, %v", mode, lc, lp, pb, len(res), err)
+					}
+				}
+			}
+		}
+	}
+}
@@ -26,6 +26,7 @@ var (
 	suffix     = flag.String("s", "lzma", "use provided suffix on compressed files")
 	level      = flag.Int("l", 5, "compression level [1 ... 9]")
 	cores      = flag.Int("cores", 1, "number of cores to use for parallelization")
+	patchFrom  = flag.String("patch-from", "", "compress FILE as a patch against `REF`, or decompress such a patch")
 
 	stdin bool
 )
@@ -52,6 +53,22 @@ func setByUser(name string) (isSet bool) {
 	return
 }
 
+// newWriter returns a Writer compressing size bytes at the level set by -l,
+// against ref if not nil.
+func newWriter(w io.Writer, size int64, ref *os.File, refSize int64) io.WriteCloser {
+	if ref == nil {
+		return lzma.NewWriterSizeLevel(w, size, *level)
+	}
+	opts, _ := lzma.LevelOptions(*level)
+	opts.Size = size
+	opts.EndMarker = size == -1
+	z, err := lzma.NewWriterPatch(w, opts, ref, refSize)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	return z
+}
+
 func main() {
 	flag.Parse()
 	if *help == true {
@@ -84,6 +101,22 @@ func main() {
 
 	runtime.GOMAXPROCS(*cores)
 
+	var ref *os.File
+	var refSize int64
+	if *patchFrom != "" {
+		var err error
+		ref, err = os.Open(*patchFrom)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		defer ref.Close()
+		f, err := ref.Stat()
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		refSize = f.Size()
+	}
+
 	var inFilePath string
 	var outFilePath string
 	if flag.NArg() == 0 || flag.NArg() == 1 && flag.Args()[0] == "-" { // parse args: read from stdin
@@ -180,7 +213,16 @@ func main() {
 
 		// write into outFile from z
 		defer pr.Close()
-		z := lzma.NewReader(pr)
+		var z io.ReadCloser
+		if ref != nil {
+			var err error
+			z, err = lzma.NewReaderPatch(pr, ref, refSize)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+		} else {
+			z = lzma.NewReader(pr)
+		}
 		defer z.Close()
 		var outFile *os.File
 		var err error
@@ -209,7 +251,7 @@ func main() {
 			if stdin == true {
 				inFile = os.Stdin
 				defer inFile.Close()
-				z = lzma.NewWriterLevel(pw, *level)
+				z = newWriter(pw, -1, ref, refSize)
 				defer z.Close()
 			} else {
 				inFile, err = os.Open(inFilePath)
@@ -221,7 +263,7 @@ func main() {
 				if err != nil {
 					log.Fatal(err.Error())
 				}
-				z = lzma.NewWriterSizeLevel(pw, int64(f.Size()), *level)
+				z = newWriter(pw, int64(f.Size()), ref, refSize)
 				defer z.Close()
 			}
 
@@ -0,0 +1,58 @@
+// Copyright (c) 2010, Andrei Vieru. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/itchio/lzma"
+)
+
+// Streams of known size have no end marker, patches or not.
+func TestNewWriterEndMarker(t *testing.T) {
+	old, err := ioutil.ReadFile("../data/data.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := ioutil.TempFile("", "lzma_go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(ref.Name())
+	defer ref.Close()
+	ref.Write(old)
+	data := append(append([]byte{}, old[:50000]...), old[60000:]...)
+
+	for _, r := range []*os.File{nil, ref} {
+		for _, size := range []int64{-1, int64(len(data))} {
+			b := new(bytes.Buffer)
+			z := newWriter(b, size, r, int64(len(old)))
+			z.Write(data)
+			if err = z.Close(); err != nil {
+				t.Fatal(err)
+			}
+			var cfg lzma.ReaderConfig
+			if r != nil {
+				if _, err = lzma.ReadPatchHeader(b); err != nil {
+					t.Fatal(err)
+				}
+				cfg.Dict = old
+			}
+			h, err := lzma.ReadHeader(b)
+			if err != nil || h.SizeKnown != (size != -1) {
+				t.Errorf("patch %v, size %d: got header %+v, %v", r != nil, size, h, err)
+			}
+			cfg.EndMarker = lzma.MarkerForbidden
+			zr := lzma.NewReaderRawConfig(b, h.Props, size, size == -1, cfg)
+			res, err := ioutil.ReadAll(zr)
+			if err != nil || !bytes.Equal(res, data) {
+				t.Errorf("patch %v, size %d: got %d bytes, %v", r != nil, size, len(res), err)
+			}
+		}
+	}
+}
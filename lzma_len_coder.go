@@ -4,6 +4,8 @@
 
 package lzma
 
+import "unsafe"
+
 type lenCoder struct {
 	choice    []uint16
 	lowCoder  []*rangeBitTreeCoder
@@ -25,6 +27,30 @@ func newLenCoder(numPosStates /*1 << pb*/ uint32) *lenCoder {
 	return lc
 }
 
+// lenCoderMemUsage returns the number of bytes newLenCoder allocates.
+func lenCoderMemUsage(numPosStates uint32) int64 {
+	mem := int64(unsafe.Sizeof(lenCoder{})) + bitModelsMemUsage(2)
+	mem += 2 * kNumPosStatesMax * int64(unsafe.Sizeof(&rangeBitTreeCoder{}))
+	mem += rangeBitTreeCoderMemUsage(kNumHighLenBits)
+	return mem + int64(numPosStates)*(rangeBitTreeCoderMemUsage(kNumLowLenBits)+rangeBitTreeCoderMemUsage(kNumMidLenBits))
+}
+
+// reset brings lc back to its initial state for a new stream, allocating the
+// coders of the position states it did not use yet.
+func (lc *lenCoder) reset(numPosStates uint32) {
+	resetBitModels(lc.choice)
+	lc.highCoder.reset()
+	for i := uint32(0); i < numPosStates; i++ {
+		if lc.lowCoder[i] == nil {
+			lc.lowCoder[i] = newRangeBitTreeCoder(kNumLowLenBits)
+			lc.midCoder[i] = newRangeBitTreeCoder(kNumMidLenBits)
+		} else {
+			lc.lowCoder[i].reset()
+			lc.midCoder[i].reset()
+		}
+	}
+}
+
 func (lc *lenCoder) decode(rd *rangeDecoder, posState uint32) (res uint32) {
 	i := rd.decodeBit(lc.choice, 0)
 	if i == 0 {
@@ -42,7 +68,6 @@ func (lc *lenCoder) decode(rd *rangeDecoder, posState uint32) (res uint32) {
 		res = res + kNumMidLenSymbols + l
 		return
 	}
-	return
 }
 
 func (lc *lenCoder) encode(re *rangeEncoder, symbol, posState uint32) {
@@ -108,6 +133,20 @@ func newLenPriceTableCoder(tableSize, numPosStates uint32) *lenPriceTableCoder {
 	return pc
 }
 
+// lenPriceTableCoderMemUsage returns the number of bytes newLenPriceTableCoder
+// allocates.
+func lenPriceTableCoderMemUsage(numPosStates uint32) int64 {
+	mem := int64(unsafe.Sizeof(lenPriceTableCoder{})) + lenCoderMemUsage(numPosStates)
+	return mem + 4*(kNumLenSymbols<<kNumPosStatesBitsMax+kNumPosStatesMax)
+}
+
+func (pc *lenPriceTableCoder) reset(numPosStates uint32) {
+	pc.lc.reset(numPosStates)
+	for posState := uint32(0); posState < numPosStates; posState++ {
+		pc.updateTable(posState)
+	}
+}
+
 func (pc *lenPriceTableCoder) updateTable(posState uint32) {
 	pc.lc.setPrices(pc.prices, posState, pc.tableSize, posState*kNumLenSymbols)
 	pc.counters[posState] = pc.tableSize
@@ -117,8 +156,13 @@ func (pc *lenPriceTableCoder) getPrice(symbol, posState uint32) uint32 {
 	return pc.prices[posState*kNumLenSymbols+symbol]
 }
 
-func (pc *lenPriceTableCoder) encode(re *rangeEncoder, symbol, posState uint32) {
+// encode encodes symbol; the price table of posState is kept up to date if
+// updatePrice is true.
+func (pc *lenPriceTableCoder) encode(re *rangeEncoder, symbol, posState uint32, updatePrice bool) {
 	pc.lc.encode(re, symbol, posState)
+	if !updatePrice {
+		return
+	}
 	pc.counters[posState]--
 	if pc.counters[posState] == 0 {
 		pc.updateTable(posState)
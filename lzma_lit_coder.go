@@ -4,16 +4,26 @@
 
 package lzma
 
+import "unsafe"
+
+// kNumLitModels is the number of probability models of a litSubCoder.
+const kNumLitModels = 0x300
+
 type litSubCoder struct {
 	coders []uint16
 }
 
 func newLitSubCoder() *litSubCoder {
 	return &litSubCoder{
-		coders: initBitModels(0x300),
+		coders: initBitModels(kNumLitModels),
 	}
 }
 
+// litSubCoderMemUsage returns the number of bytes newLitSubCoder allocates.
+func litSubCoderMemUsage() int64 {
+	return int64(unsafe.Sizeof(litSubCoder{})) + bitModelsMemUsage(kNumLitModels)
+}
+
 
 func (lsc *litSubCoder) decodeNormal(rd *rangeDecoder) byte {
 	symbol := uint32(1)
@@ -105,17 +115,21 @@ func (lsc *litSubCoder) getPrice(matchMode bool, matchByte, symbol byte) uint32
 type litCoder struct {
 	coders      []*litSubCoder
 	numPrevBits uint32 // literal context bits // lc
-	// numPosBits  uint32 // literal position state bits // lp
-	posMask uint32
+	posMask     uint32 // literal position state bits, as a mask // lp
+}
+
+// numLitStates returns the number of sub coders of a litCoder with lp and lc
+// set to numPosBits and numPrevBits.
+func numLitStates(numPosBits, numPrevBits uint32) uint32 {
+	return 1 << (numPrevBits + numPosBits)
 }
 
 func newLitCoder(numPosBits, numPrevBits uint32) *litCoder {
-	numStates := uint32(1) << (numPrevBits + numPosBits)
+	numStates := numLitStates(numPosBits, numPrevBits)
 	lc := &litCoder{
 		coders:      make([]*litSubCoder, numStates),
 		numPrevBits: numPrevBits,
-		// numPosBits:  numPosBits,
-		posMask: (1 << numPosBits) - 1,
+		posMask:     (1 << numPosBits) - 1,
 	}
 	for i := uint32(0); i < numStates; i++ {
 		lc.coders[i] = newLitSubCoder()
@@ -123,6 +137,34 @@ func newLitCoder(numPosBits, numPrevBits uint32) *litCoder {
 	return lc
 }
 
+// litCoderMemUsage returns the number of bytes newLitCoder allocates.
+func litCoderMemUsage(numPosBits, numPrevBits uint32) int64 {
+	numStates := int64(numLitStates(numPosBits, numPrevBits))
+	return int64(unsafe.Sizeof(litCoder{})) + numStates*(int64(unsafe.Sizeof(&litSubCoder{}))+litSubCoderMemUsage())
+}
+
+// reset brings lc back to its initial state for a new stream, with possibly
+// different parameters. The sub coders are reused and allocated as needed.
+func (lc *litCoder) reset(numPosBits, numPrevBits uint32) {
+	numStates := numLitStates(numPosBits, numPrevBits)
+	coders := lc.coders[:cap(lc.coders)]
+	for i := uint32(0); i < numStates; i++ {
+		if i >= uint32(len(coders)) {
+			coders = append(coders, newLitSubCoder())
+		} else if coders[i] == nil {
+			coders[i] = newLitSubCoder()
+		} else {
+			resetBitModels(coders[i].coders)
+		}
+	}
+	lc.coders = coders[:numStates]
+	lc.numPrevBits = numPrevBits
+	lc.posMask = (1 << numPosBits) - 1
+}
+
+// getSubCoder returns the coder of the literal at position pos, following
+// prevByte: its state is made of the lp low bits of pos and the lc high bits
+// of prevByte.
 func (lc *litCoder) getSubCoder(pos uint32, prevByte byte) *litSubCoder {
 	return lc.coders[((pos&lc.posMask)<<lc.numPrevBits)+uint32(prevByte>>(8-lc.numPrevBits))]
 }
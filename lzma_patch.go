@@ -0,0 +1,187 @@
+// Copyright (c) 2010, Andrei Vieru. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lzma
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Patches encode a file against a reference, typically the previous version
+// of the same file: the reference is preloaded in the dictionary, so that what
+// did not change between the two versions is encoded as long matches. A patch
+// is an .lzma stream preceded by a patch header identifying the reference.
+
+const patchHeaderSize = 4 + 8 + sha256.Size
+
+var patchMagic = []byte("LZPF")
+
+// ErrReferenceMismatch is returned by a Reader given a patch made against
+// another reference than its own.
+var ErrReferenceMismatch = errors.New("lzma: patch made against another reference")
+
+// A PatchHeader is the header of a patch, written before the .lzma header: the
+// size and the SHA-256 hash of the reference the patch was made against.
+type PatchHeader struct {
+	RefSize int64
+	RefHash [sha256.Size]byte
+}
+
+// NewPatchHeader returns the header of a patch made against the size bytes of
+// ref. It reads the whole reference.
+func NewPatchHeader(ref io.ReaderAt, size int64) (h PatchHeader, err error) {
+	if size < 0 {
+		return h, &argumentValueError{"illegal reference size", size}
+	}
+	d := sha256.New()
+	n, err := io.Copy(d, io.NewSectionReader(ref, 0, size))
+	if err != nil {
+		return
+	}
+	if n < size {
+		return h, io.ErrUnexpectedEOF
+	}
+	h.RefSize = size
+	copy(h.RefHash[:], d.Sum(nil))
+	return
+}
+
+// ReadPatchHeader reads the header of a patch from r, leaving r at the start
+// of the .lzma header.
+func ReadPatchHeader(r io.Reader) (h PatchHeader, err error) {
+	var buf [patchHeaderSize]byte
+	if _, err = io.ReadFull(r, buf[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = ErrUnexpectedEOF
+		}
+		return
+	}
+	err = h.UnmarshalBinary(buf[:])
+	return
+}
+
+// MarshalBinary encodes h in the 44 bytes of the patch header.
+func (h *PatchHeader) MarshalBinary() ([]byte, error) {
+	if h.RefSize < 0 {
+		return nil, &argumentValueError{"illegal reference size", h.RefSize}
+	}
+	buf := make([]byte, patchHeaderSize)
+	copy(buf, patchMagic)
+	binary.LittleEndian.PutUint64(buf[4:], uint64(h.RefSize))
+	copy(buf[12:], h.RefHash[:])
+	return buf, nil
+}
+
+// UnmarshalBinary decodes the patch header at the start of b. It fails with
+// ErrUnexpectedEOF if b is too short, or with ErrHeader if b does not start
+// with a patch header.
+func (h *PatchHeader) UnmarshalBinary(b []byte) error {
+	if len(b) < patchHeaderSize {
+		return ErrUnexpectedEOF
+	}
+	size := int64(binary.LittleEndian.Uint64(b[4:]))
+	if !bytes.Equal(b[:4], patchMagic) || size < 0 {
+		return ErrHeader
+	}
+	h.RefSize = size
+	copy(h.RefHash[:], b[12:])
+	return nil
+}
+
+// readTail fills p with the last bytes of the size bytes of r.
+func readTail(r io.ReaderAt, size int64, p []byte) error {
+	n, err := r.ReadAt(p, size-int64(len(p)))
+	if n == len(p) {
+		return nil
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// NewWriterPatch is like NewWriterOptions, but the data is encoded against the
+// refSize bytes of ref, as a patch to be decoded by NewReaderPatch with the
+// same reference. The patch header is written first.
+//
+// The dictionary is enlarged by refSize, up to MaxDictSize, so as to hold the
+// whole reference, which is read from ref into it at the start of each stream.
+// A reference larger than MaxDictSize is rejected with an error matching
+// ErrInvalidOption. EncoderMemoryUsagePatch gives the memory used.
+//
+func NewWriterPatch(w io.Writer, opts WriterOptions, ref io.ReaderAt, refSize int64) (*Writer, error) {
+	if err := patchOptions(&opts, refSize); err != nil {
+		return nil, err
+	}
+	h, err := NewPatchHeader(ref, refSize)
+	if err != nil {
+		return nil, err
+	}
+	zw := newWriter(w, &opts, true)
+	zw.z.preset, zw.z.presetSize = ref, refSize
+	zw.refHeader, _ = h.MarshalBinary()
+	return zw, nil
+}
+
+// EncoderMemoryUsagePatch is EncoderMemoryUsage for a Writer from
+// NewWriterPatch with a reference of refSize bytes, which its dictionary holds
+// without a copy being made, and the patch header it keeps.
+//
+func EncoderMemoryUsagePatch(opts WriterOptions, refSize int64) (int64, error) {
+	if err := patchOptions(&opts, refSize); err != nil {
+		return 0, err
+	}
+	return encoderMemUsage(&opts, refSize) + patchHeaderSize, nil
+}
+
+// patchOptions checks opts and enlarges their dictionary by refSize.
+func patchOptions(opts *WriterOptions, refSize int64) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	if refSize < 0 || refSize > MaxDictSize {
+		return &argumentValueError{"reference size out of range", refSize}
+	}
+	opts.DictSize = dictSizeFor(MaxDictSize, refSize+int64(opts.DictSize))
+	return nil
+}
+
+// NewReaderPatch returns a Reader decoding a patch made by NewWriterPatch
+// against the refSize bytes of ref, which it reads whole to check them against
+// the patch header. Decoding fails with ErrReferenceMismatch if the patch was
+// made against another reference. ref is read again, but only its end, at the
+// start of each stream. The ReadCloser is a *Reader.
+//
+func NewReaderPatch(r io.Reader, ref io.ReaderAt, refSize int64) (io.ReadCloser, error) {
+	h, err := NewPatchHeader(ref, refSize)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{r: r, ref: ref, refHeader: h}, nil
+}
+
+// readPatchHeader reads the patch header and checks it against the reference
+// of the Reader.
+func (zr *Reader) readPatchHeader() {
+	var buf [patchHeaderSize]byte
+	n, err := io.ReadFull(zr.r, buf[:])
+	zr.z.headerLen = int64(n)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = ErrUnexpectedEOF
+	}
+	if err != nil {
+		throw(err)
+	}
+	var h PatchHeader
+	if err = h.UnmarshalBinary(buf[:]); err != nil {
+		throw(err)
+	}
+	if h != zr.refHeader {
+		throw(ErrReferenceMismatch)
+	}
+}
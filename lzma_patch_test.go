@@ -0,0 +1,167 @@
+// Copyright (c) 2010, Andrei Vieru. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lzma
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// newVersion returns a copy of old with some bytes changed, inserted and
+// removed, as a new version of a file would.
+func newVersion(old []byte) []byte {
+	data := append([]byte{}, old[:30000]...)
+	data = append(data, "inserted text"...)
+	data = append(data, old[30000:60000]...)
+	data = append(data, old[61000:]...)
+	for i := 1000; i < len(data); i += 7919 {
+		data[i] ^= 0x55
+	}
+	return data
+}
+
+func TestPatch(t *testing.T) {
+	ref := bench.raw[:100000]
+	data := newVersion(ref)
+	for _, size := range []int64{-1, int64(len(data))} {
+		opts, _ := LevelOptions(DefaultCompression)
+		opts.DictSize = MinDictSize
+		opts.Size = size
+		b := new(bytes.Buffer)
+		w, err := NewWriterPatch(b, opts, bytes.NewReader(ref), int64(len(ref)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if b.Len() > 1000 {
+			t.Errorf("size %d: got a %d-byte patch", size, b.Len())
+		}
+
+		h, err := ReadPatchHeader(bytes.NewReader(b.Bytes()))
+		if want, _ := NewPatchHeader(bytes.NewReader(ref), int64(len(ref))); err != nil || h != want {
+			t.Errorf("size %d: got patch header %+v, %v", size, h, err)
+		}
+		r, err := NewReaderPatch(bytes.NewReader(b.Bytes()), bytes.NewReader(ref), int64(len(ref)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			r.(*Reader).Reset(bytes.NewReader(b.Bytes()))
+			res, err := ioutil.ReadAll(r)
+			if err != nil || !bytes.Equal(res, data) {
+				t.Errorf("size %d: got %d bytes, %v", size, len(res), err)
+			}
+		}
+
+		other := append([]byte{}, ref...)
+		other[50000]++
+		r, _ = NewReaderPatch(bytes.NewReader(b.Bytes()), bytes.NewReader(other), int64(len(other)))
+		if _, err = ioutil.ReadAll(r); err != ErrReferenceMismatch {
+			t.Errorf("size %d: got error %v, want %v", size, err, ErrReferenceMismatch)
+		}
+	}
+}
+
+// zeroReaderAt is a ReaderAt of any size, full of zeros.
+type zeroReaderAt struct{}
+
+func (zeroReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestPatchLargeReference(t *testing.T) {
+	opts, _ := LevelOptions(DefaultCompression)
+	opts.DictSize = MinDictSize
+	// the reference must fit the dictionary
+	_, err := NewWriterPatch(new(bytes.Buffer), opts, zeroReaderAt{}, MaxDictSize+1)
+	if !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("got error %v, want %v", err, ErrInvalidOption)
+	}
+	if _, err = EncoderMemoryUsagePatch(opts, MaxDictSize+1); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("got error %v, want %v", err, ErrInvalidOption)
+	}
+}
+
+func TestPatchMemoryUsage(t *testing.T) {
+	ref := bench.raw[:100000]
+	data := newVersion(ref)
+	refReader := bytes.NewReader(ref)
+	buf := make([]byte, 1000)
+	// hashing the reference allocates too, but nothing that is kept
+	hashing := allocated(func() { NewPatchHeader(refReader, int64(len(ref))) })
+	for _, size := range []int64{-1, int64(len(data))} {
+		opts, _ := LevelOptions(DefaultCompression)
+		opts.DictSize = MinDictSize
+		opts.Size = size
+		want, err := EncoderMemoryUsagePatch(opts, int64(len(ref)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := new(bytes.Buffer)
+		b.Grow(1000)
+		got := allocated(func() {
+			w, _ := NewWriterPatch(b, opts, refReader, int64(len(ref)))
+			w.Write(data)
+			w.Close()
+		}) - hashing
+		if got < want || got > want+encoderRounding {
+			t.Errorf("size %d: allocated %d bytes, computed %d", size, got, want)
+		}
+
+		h, _ := ReadPatchHeader(bytes.NewReader(b.Bytes()))
+		lh, _ := ReadHeader(bytes.NewReader(b.Bytes()[patchHeaderSize:]))
+		if lh.SizeKnown {
+			lh.UncompressedSize += h.RefSize
+		}
+		want = DecoderMemoryUsage(lh)
+		in := &oneByteReader{bytes.NewReader(b.Bytes())}
+		got = allocated(func() {
+			r, _ := NewReaderPatch(in, refReader, int64(len(ref)))
+			io.ReadFull(r, buf)
+		}) - hashing
+		if got < want || got > want+decoderRounding {
+			t.Errorf("size %d: allocated %d bytes to decode, computed %d", size, got, want)
+		}
+	}
+}
+
+func TestPatchHeader(t *testing.T) {
+	h, err := NewPatchHeader(bytes.NewReader(bench.raw), int64(len(bench.raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := h.MarshalBinary()
+	if err != nil || len(b) != patchHeaderSize {
+		t.Fatalf("got %d bytes, %v", len(b), err)
+	}
+	var h2 PatchHeader
+	if err = h2.UnmarshalBinary(b); err != nil || h2 != h {
+		t.Errorf("got %+v, %v, want %+v", h2, err, h)
+	}
+	if err = h2.UnmarshalBinary(b[:patchHeaderSize-1]); err != ErrUnexpectedEOF {
+		t.Errorf("got error %v, want %v", err, ErrUnexpectedEOF)
+	}
+	b[0] = 'X'
+	if err = h2.UnmarshalBinary(b); err != ErrHeader {
+		t.Errorf("got error %v, want %v", err, ErrHeader)
+	}
+	// a plain .lzma stream is not a patch
+	r, _ := NewReaderPatch(bytes.NewReader(bench.lzma), bytes.NewReader(nil), 0)
+	if _, err = ioutil.ReadAll(r); !errors.Is(err, ErrHeader) {
+		t.Errorf("got error %v, want %v", err, ErrHeader)
+	}
+	if _, err = NewPatchHeader(bytes.NewReader(bench.raw), int64(len(bench.raw))+1); err == nil {
+		t.Errorf("got no error for a short reference")
+	}
+}
@@ -4,6 +4,8 @@
 
 package lzma
 
+import "unsafe"
+
 type rangeBitTreeCoder struct {
 	models       []uint16 // length(models) is at most 1<<8
 	numBitLevels uint32   // min 2; max 8
@@ -16,6 +18,16 @@ func newRangeBitTreeCoder(numBitLevels uint32) *rangeBitTreeCoder {
 	}
 }
 
+// rangeBitTreeCoderMemUsage returns the number of bytes newRangeBitTreeCoder
+// allocates.
+func rangeBitTreeCoderMemUsage(numBitLevels uint32) int64 {
+	return int64(unsafe.Sizeof(rangeBitTreeCoder{})) + bitModelsMemUsage(1<<numBitLevels)
+}
+
+func (rc *rangeBitTreeCoder) reset() {
+	resetBitModels(rc.models)
+}
+
 func (rc *rangeBitTreeCoder) decode(rd *rangeDecoder) (res uint32) {
 	res = 1
 	for bitIndex := rc.numBitLevels; bitIndex != 0; bitIndex-- {
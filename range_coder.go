@@ -7,8 +7,13 @@ package lzma
 import (
 	"bufio"
 	"io"
+	"unsafe"
 )
 
+// ioBufSize is the size of the buffer introduced by the range coders for the
+// readers and writers lacking the methods they need.
+const ioBufSize = 4096
+
 const (
 	kTopValue             = 1 << 24
 	kNumBitModelTotalBits = 11
@@ -16,42 +21,98 @@ const (
 	kNumMoveBits          = 5
 )
 
-// The actual read interface needed by NewDecoder. If the passed in io.Reader
-// does not also have ReadByte, the NewDecoder will introduce its own buffering.
+// The actual read interface needed by the range decoder. If the passed in
+// io.Reader does not also have ReadByte, the range decoder will introduce its
+// own buffering.
 //
-type Reader interface {
+type byteReader interface {
 	io.Reader
 	ReadByte() (c byte, err error)
 }
 
 type rangeDecoder struct {
-	r      Reader
+	r      byteReader
+	br     *bufio.Reader // buffering of r, kept for reuse
 	rrange uint32
 	code   uint32
+	first  byte  // first byte of the stream, always 0 for valid streams
+	n      int64 // number of bytes read
+	next   byte  // byte read ahead by atEOF, if peeked
+	peeked bool
+}
+
+func newRangeDecoder(r io.Reader) *rangeDecoder {
+	rd := &rangeDecoder{}
+	rd.init(r)
+	return rd
+}
+
+// rangeDecoderMemUsage returns the number of bytes newRangeDecoder allocates
+// for an r without ReadByte.
+func rangeDecoderMemUsage() int64 {
+	return int64(unsafe.Sizeof(rangeDecoder{})+unsafe.Sizeof(bufio.Reader{})) + ioBufSize
 }
 
-func makeReader(r io.Reader) Reader {
-	if rr, ok := r.(Reader); ok {
-		return rr
+// init makes rd ready to decode the stream read from r. The buffering
+// introduced for r, if any, is reused from the previous stream.
+func (rd *rangeDecoder) init(r io.Reader) {
+	if rr, ok := r.(byteReader); ok {
+		rd.r = rr
+	} else {
+		if rd.br == nil {
+			rd.br = bufio.NewReaderSize(r, ioBufSize)
+		} else {
+			rd.br.Reset(r)
+		}
+		rd.r = rd.br
+	}
+	rd.rrange = 0xFFFFFFFF
+	rd.code = 0
+	rd.n = 0
+	rd.peeked = false
+	for i := 0; i < 5; i++ {
+		b := rd.readByte()
+		if i == 0 {
+			rd.first = b
+		}
+		rd.code = rd.code<<8 | uint32(b)
 	}
-	return bufio.NewReader(r)
 }
 
-func newRangeDecoder(r io.Reader) *rangeDecoder {
-	rd := &rangeDecoder{
-		r:      makeReader(r),
-		rrange: 0xFFFFFFFF,
-		code:   0,
+// readByte returns the next byte of the stream. The stream never ends inside
+// the range coder, so running out of input is reported as ErrUnexpectedEOF.
+func (rd *rangeDecoder) readByte() byte {
+	if rd.peeked {
+		rd.peeked = false
+		rd.n++
+		return rd.next
 	}
-	buf := make([]byte, 5)
-	_, err := io.ReadFull(rd.r, buf)
+	b, err := rd.r.ReadByte()
 	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = ErrUnexpectedEOF
+		}
 		throw(err)
 	}
-	for i := 0; i < len(buf); i++ {
-		rd.code = rd.code<<8 | uint32(buf[i])
+	rd.n++
+	return b
+}
+
+// atEOF reports whether the input is exhausted. The byte it reads otherwise
+// is kept for the next readByte, so that r need not support UnreadByte.
+func (rd *rangeDecoder) atEOF() bool {
+	if rd.peeked {
+		return false
+	}
+	b, err := rd.r.ReadByte()
+	if err == io.EOF {
+		return true
 	}
-	return rd
+	if err != nil {
+		throw(err)
+	}
+	rd.next, rd.peeked = b, true
+	return false
 }
 
 func (rd *rangeDecoder) decodeDirectBits(numTotalBits uint32) (res uint32) {
@@ -61,11 +122,7 @@ func (rd *rangeDecoder) decodeDirectBits(numTotalBits uint32) (res uint32) {
 		rd.code -= rd.rrange & (t - 1)
 		res = res<<1 | (1 - t)
 		if rd.rrange < kTopValue {
-			c, err := rd.r.ReadByte()
-			if err != nil {
-				throw(err)
-			}
-			rd.code = rd.code<<8 | uint32(c)
+			rd.code = rd.code<<8 | uint32(rd.readByte())
 			rd.rrange <<= 8
 		}
 	}
@@ -79,11 +136,7 @@ func (rd *rangeDecoder) decodeBit(probs []uint16, index uint32) (res uint32) {
 		rd.rrange = newBound
 		probs[index] = prob + (kBitModelTotal-prob)>>kNumMoveBits
 		if rd.rrange < kTopValue {
-			b, err := rd.r.ReadByte()
-			if err != nil {
-				throw(err)
-			}
-			rd.code = rd.code<<8 | uint32(b)
+			rd.code = rd.code<<8 | uint32(rd.readByte())
 			rd.rrange <<= 8
 		}
 		res = 0
@@ -92,11 +145,7 @@ func (rd *rangeDecoder) decodeBit(probs []uint16, index uint32) (res uint32) {
 		rd.code -= newBound
 		probs[index] = prob - prob>>kNumMoveBits
 		if rd.rrange < kTopValue {
-			b, err := rd.r.ReadByte()
-			if err != nil {
-				throw(err)
-			}
-			rd.code = rd.code<<8 | uint32(b)
+			rd.code = rd.code<<8 | uint32(rd.readByte())
 			rd.rrange <<= 8
 		}
 		res = 1
@@ -106,11 +155,30 @@ func (rd *rangeDecoder) decodeBit(probs []uint16, index uint32) (res uint32) {
 
 func initBitModels(length uint32) (probs []uint16) {
 	probs = make([]uint16, length)
+	resetBitModels(probs)
+	return
+}
+
+// bitModelsMemUsage returns the number of bytes initBitModels allocates.
+func bitModelsMemUsage(length uint32) int64 {
+	return 2 * int64(length)
+}
+
+// reuseBitModels is like initBitModels, but reuses probs if it is big enough.
+func reuseBitModels(probs []uint16, length uint32) []uint16 {
+	if uint32(cap(probs)) < length {
+		return initBitModels(length)
+	}
+	probs = probs[:length]
+	resetBitModels(probs)
+	return probs
+}
+
+func resetBitModels(probs []uint16) {
 	val := uint16(kBitModelTotal) >> 1
-	for i := uint32(0); i < length; i++ {
+	for i := range probs {
 		probs[i] = val // 1 << 10
 	}
-	return
 }
 
 const (
@@ -118,41 +186,59 @@ const (
 	kNumBitPriceShiftBits = 6
 )
 
-// The actual write interface needed by NewEncoder. If the passed in io.Writer
-// does not also have WriteByte and Flush, the NewEncoder will wrap it into an
-// bufio.Writer.
+// The actual write interface needed by the range encoder. If the passed in
+// io.Writer does not also have WriteByte and Flush, the range encoder will wrap
+// it into an bufio.Writer.
 //
-type Writer interface {
+type byteWriter interface {
 	io.Writer
 	Flush() error
 	WriteByte(c byte) error
 }
 
 type rangeEncoder struct {
-	w         Writer
+	w         byteWriter
+	bw        *bufio.Writer // buffering of w, kept for reuse
 	low       uint64
 	pos       uint64
 	cacheSize uint32
 	cache     uint32
 	rrange    uint32
+	price     uint64 // price of the bits encoded so far, if pricing
+	pricing   bool   // keep price up to date, for Writer.Stats
 }
 
-func makeWriter(w io.Writer) Writer {
-	if ww, ok := w.(Writer); ok {
-		return ww
-	}
-	return bufio.NewWriter(w)
+func newRangeEncoder(w io.Writer) *rangeEncoder {
+	re := &rangeEncoder{}
+	re.init(w)
+	return re
 }
 
-func newRangeEncoder(w io.Writer) *rangeEncoder {
-	return &rangeEncoder{
-		w:         makeWriter(w),
-		low:       0,
-		pos:       0,
-		cacheSize: 1,
-		cache:     0,
-		rrange:    0xFFFFFFFF,
+// rangeEncoderMemUsage returns the number of bytes newRangeEncoder allocates
+// for a w without WriteByte and Flush.
+func rangeEncoderMemUsage() int64 {
+	return int64(unsafe.Sizeof(rangeEncoder{})+unsafe.Sizeof(bufio.Writer{})) + ioBufSize
+}
+
+// init makes re ready to encode a new stream to w. The buffering introduced
+// for w, if any, is reused from the previous stream.
+func (re *rangeEncoder) init(w io.Writer) {
+	if ww, ok := w.(byteWriter); ok {
+		re.w = ww
+	} else {
+		if re.bw == nil {
+			re.bw = bufio.NewWriterSize(w, ioBufSize)
+		} else {
+			re.bw.Reset(w)
+		}
+		re.w = re.bw
 	}
+	re.low = 0
+	re.pos = 0
+	re.cacheSize = 1
+	re.cache = 0
+	re.rrange = 0xFFFFFFFF
+	re.price = 0
 }
 
 func (re *rangeEncoder) flush() {
@@ -186,6 +272,9 @@ func (re *rangeEncoder) shiftLow() {
 }
 
 func (re *rangeEncoder) encodeDirectBits(v, numTotalBits uint32) {
+	if re.pricing {
+		re.price += uint64(numTotalBits) << kNumBitPriceShiftBits
+	}
 	for i := numTotalBits - 1; int32(i) >= 0; i-- {
 		re.rrange >>= 1
 		if (v>>i)&1 == 1 {
@@ -204,6 +293,9 @@ func (re *rangeEncoder) processedSize() uint64 {
 
 func (re *rangeEncoder) encode(probs []uint16, index, symbol uint32) {
 	prob := probs[index]
+	if re.pricing {
+		re.price += uint64(getPrice(prob, symbol))
+	}
 	newBound := (re.rrange >> kNumBitModelTotalBits) * uint32(prob)
 	if symbol == 0 {
 		re.rrange = newBound
@@ -221,7 +313,7 @@ func (re *rangeEncoder) encode(probs []uint16, index, symbol uint32) {
 
 var probPrices []uint32 = make([]uint32, kBitModelTotal>>kNumMoveReducingBits) // len(probPrices) = 512
 
-// should be called in the encoder's contructor.
+// should be called through tablesOnce
 func initProbPrices() {
 	kNumBits := uint32(kNumBitModelTotalBits - kNumMoveReducingBits)
 	for i := kNumBits - 1; int32(i) >= 0; i-- {
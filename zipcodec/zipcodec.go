@@ -0,0 +1,238 @@
+// Copyright (c) 2010, Andrei Vieru. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The zipcodec package plugs the lzma package into archive/zip, so that
+// entries compressed with the LZMA method (14) can be read and written.
+//
+// Usage example. Read any zip file, LZMA entries included:
+//
+//  zipcodec.Register()
+//  zr, err := zip.OpenReader("archive.zip")
+//
+// or, honouring the flags and the size of the entries, read an LZMA entry f of
+// the zip file read from ra:
+//
+//  rc, err := zipcodec.Open(ra, f)
+//
+// and write an LZMA entry:
+//
+//  fw, err := zipcodec.CreateHeader(zw, &zip.FileHeader{Name: "hello.txt"}, lzma.DefaultCompression)
+//  fw.Write([]byte("hello, world\n"))
+//
+package zipcodec
+
+import (
+	"archive/zip"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sync"
+
+	"github.com/itchio/lzma"
+)
+
+const (
+	// Method is the zip compression method of LZMA compressed entries.
+	Method uint16 = 14
+
+	// FlagEOS is the general purpose flag bit telling that the compressed
+	// data of an entry is terminated by an end marker.
+	FlagEOS uint16 = 0x2
+
+	// version of the LZMA SDK stored in the entries we write; it is the
+	// version the lzma package was derived from.
+	versionMajor = 4
+	versionMinor = 65
+
+	propSize   = 5
+	prefixSize = 4 + propSize
+)
+
+// Every LZMA entry starts with a prefix of its own:
+//
+// Offset Size 	      Description
+//   0     1   		LZMA SDK major version
+//   1     1   		LZMA SDK minor version
+//   2     2   		Size of the properties (little endian), always 5
+//   4     5   		LZMA properties, as in the .lzma header
+//
+// and is followed by a raw lzma stream, with an end marker if FlagEOS is set.
+
+func readPrefix(r io.Reader) (p lzma.Props, err error) {
+	buf := make([]byte, prefixSize)
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = lzma.ErrUnexpectedEOF
+		}
+		return
+	}
+	if int(buf[2])|int(buf[3])<<8 != propSize {
+		err = lzma.ErrHeader
+		return
+	}
+	err = p.UnmarshalBinary(buf[4:])
+	return
+}
+
+func writePrefix(w io.Writer, p lzma.Props) error {
+	props, err := p.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	buf := append([]byte{versionMajor, versionMinor, propSize, 0}, props...)
+	_, err = w.Write(buf)
+	return err
+}
+
+type errReadCloser struct {
+	err error
+}
+
+func (e *errReadCloser) Read(p []byte) (int, error) {
+	return 0, e.err
+}
+
+func (e *errReadCloser) Close() error {
+	return nil
+}
+
+// Decompressor is a zip.Decompressor for LZMA entries.
+//
+// archive/zip does not tell decompressors the flags nor the size of an entry,
+// so the end of the stream is found either by its end marker, as for entries
+// with FlagEOS set, or by the end of r, as for entries without it. Open does
+// not have to guess.
+//
+func Decompressor(r io.Reader) io.ReadCloser {
+	p, err := readPrefix(r)
+	if err != nil {
+		return &errReadCloser{err}
+	}
+	return lzma.NewReaderRaw(r, p, -1, false)
+}
+
+// Open is like f.Open for an LZMA entry f of the zip file read from r, but the
+// stream is decoded as told by the header of f: up to its uncompressed size,
+// and with an end marker only if FlagEOS is set. Like f.Open, reading fails
+// with zip.ErrChecksum if the CRC-32 of the data does not match. Open fails
+// with zip.ErrAlgorithm if f is not an LZMA entry.
+//
+func Open(r io.ReaderAt, f *zip.File) (io.ReadCloser, error) {
+	if f.Method != Method {
+		return nil, zip.ErrAlgorithm
+	}
+	off, err := f.DataOffset()
+	if err != nil {
+		return nil, err
+	}
+	sr := io.NewSectionReader(r, off, int64(f.CompressedSize64))
+	p, err := readPrefix(sr)
+	if err != nil {
+		return nil, err
+	}
+	size := int64(f.UncompressedSize64)
+	rc := lzma.NewReaderRaw(sr, p, size, f.Flags&FlagEOS != 0)
+	return &checksumReader{rc: rc, hash: crc32.NewIEEE(), crc: f.CRC32, size: size}, nil
+}
+
+// checksumReader checks the size and the CRC-32 of the data read from rc.
+type checksumReader struct {
+	rc   io.ReadCloser
+	hash hash.Hash32
+	crc  uint32
+	size int64
+	n    int64
+}
+
+func (r *checksumReader) Read(p []byte) (int, error) {
+	n, err := r.rc.Read(p)
+	r.hash.Write(p[:n])
+	r.n += int64(n)
+	if err == io.EOF && (r.n != r.size || r.hash.Sum32() != r.crc) {
+		err = zip.ErrChecksum
+	}
+	return n, err
+}
+
+func (r *checksumReader) Close() error {
+	return r.rc.Close()
+}
+
+type compressor struct {
+	w     io.Writer
+	level int
+	zw    io.WriteCloser
+	err   error
+}
+
+func (c *compressor) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.zw == nil {
+		var props lzma.Props
+		props, c.err = lzma.LevelProps(c.level)
+		if c.err == nil {
+			c.err = writePrefix(c.w, props)
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+		c.zw = lzma.NewWriterRaw(c.w, -1, c.level, true)
+	}
+	return c.zw.Write(p)
+}
+
+func (c *compressor) Close() error {
+	if c.zw == nil {
+		// the prefix is still to be written, even for empty entries
+		if _, err := c.Write(nil); err != nil {
+			return err
+		}
+	}
+	return c.zw.Close()
+}
+
+// newCompressor returns a zip.Compressor for LZMA entries, compressing with
+// the given level. The entries are terminated by an end marker, as the size
+// of their data is not known in advance.
+func newCompressor(level int) zip.Compressor {
+	return func(w io.Writer) (io.WriteCloser, error) {
+		return &compressor{w: w, level: level}, nil
+	}
+}
+
+var registerOnce sync.Once
+
+// Register registers the LZMA decompressor in archive/zip, for all zip
+// readers. It is safe to call Register more than once.
+//
+// No compressor is registered: LZMA entries are written by CreateHeader only.
+//
+func Register() {
+	registerOnce.Do(func() {
+		zip.RegisterDecompressor(Method, Decompressor)
+	})
+}
+
+// CreateHeader is like zw.CreateHeader, but the entry is compressed with the
+// LZMA method, with the given level; level is any integer value between
+// lzma.BestSpeed and lzma.BestCompression.
+//
+// The compressed data is terminated by an end marker, which CreateHeader sets
+// FlagEOS for. The compressor is registered in zw only for the entry, so that
+// zw.CreateHeader fails with zip.ErrAlgorithm for LZMA entries, rather than
+// write them without the flag.
+//
+func CreateHeader(zw *zip.Writer, fh *zip.FileHeader, level int) (io.Writer, error) {
+	if _, err := lzma.LevelProps(level); err != nil {
+		return nil, err
+	}
+	fh.Method = Method
+	fh.Flags |= FlagEOS
+	zw.RegisterCompressor(Method, newCompressor(level))
+	defer zw.RegisterCompressor(Method, nil)
+	return zw.CreateHeader(fh)
+}
@@ -0,0 +1,262 @@
+// Copyright (c) 2010, Andrei Vieru. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package zipcodec
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/itchio/lzma"
+)
+
+func readFile(t *testing.T, filename string) []byte {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return b
+}
+
+// readEntries reads the entries of zr, with open or, if open is nil, with
+// their Open method.
+func readEntries(t *testing.T, zr *zip.Reader, open func(f *zip.File) (io.ReadCloser, error)) map[string][]byte {
+	entries := make(map[string][]byte)
+	for _, f := range zr.File {
+		if f.Method != Method {
+			t.Errorf("%s: method is %d, want %d", f.Name, f.Method, Method)
+		}
+		if open == nil {
+			open = (*zip.File).Open
+		}
+		rc, err := open(f)
+		if err != nil {
+			t.Fatalf("%s: %v", f.Name, err)
+		}
+		b, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", f.Name, err)
+		}
+		entries[f.Name] = b
+	}
+	return entries
+}
+
+// testdata/python.zip was written by Python's zipfile module (backed by
+// liblzma) with ZIP_LZMA compression, which sets FlagEOS on every entry. It is
+// not a 7-Zip archive: entries without FlagEOS, as 7-Zip may write, are only
+// covered by TestDecompressorNoEOS and TestOpen, with entries made alike.
+func TestReadPythonArchive(t *testing.T) {
+	Register()
+	zr, err := zip.OpenReader("testdata/python.zip")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		if f.Flags&FlagEOS == 0 {
+			t.Errorf("%s: FlagEOS not set", f.Name)
+		}
+	}
+	entries := readEntries(t, &zr.Reader, nil)
+	want := map[string][]byte{
+		"hello.txt": []byte("hello world\n"),
+		"empty.txt": []byte{},
+		"data.txt":  readFile(t, "../data/data.txt")[:65536],
+	}
+	for name, b := range want {
+		if !bytes.Equal(entries[name], b) {
+			t.Errorf("%s: got %d bytes, want %d bytes", name, len(entries[name]), len(b))
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	payloads := map[string][]byte{
+		"hello.txt": []byte("hello world\n"),
+		"empty.txt": []byte{},
+		"data.txt":  readFile(t, "../data/data.txt"),
+	}
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	for name, b := range payloads {
+		fw, err := CreateHeader(zw, &zip.FileHeader{Name: name}, lzma.BestSpeed)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if _, err := fw.Write(b); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	zr.RegisterDecompressor(Method, Decompressor)
+	for _, f := range zr.File {
+		if f.Flags&FlagEOS == 0 {
+			t.Errorf("%s: FlagEOS not set", f.Name)
+		}
+	}
+	ra := bytes.NewReader(buf.Bytes())
+	for _, open := range []func(f *zip.File) (io.ReadCloser, error){
+		nil,
+		func(f *zip.File) (io.ReadCloser, error) { return Open(ra, f) },
+	} {
+		entries := readEntries(t, zr, open)
+		for name, b := range payloads {
+			if !bytes.Equal(entries[name], b) {
+				t.Errorf("%s: got %d bytes, want %d bytes", name, len(entries[name]), len(b))
+			}
+		}
+	}
+}
+
+// Without CreateHeader, no LZMA entry can be written, as it would miss FlagEOS.
+func TestCreateHeaderOnly(t *testing.T) {
+	Register()
+	zw := zip.NewWriter(new(bytes.Buffer))
+	if _, err := CreateHeader(zw, &zip.FileHeader{Name: "a"}, lzma.BestSpeed); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := zw.CreateHeader(&zip.FileHeader{Name: "b", Method: Method}); err != zip.ErrAlgorithm {
+		t.Errorf("got error %v, want %v", err, zip.ErrAlgorithm)
+	}
+	if _, err := CreateHeader(zw, &zip.FileHeader{Name: "c"}, lzma.BestCompression+1); err == nil {
+		t.Errorf("got no error for level %d", lzma.BestCompression+1)
+	}
+}
+
+// noEOSWriter writes the LZMA entry of size bytes with no end marker, as 7-Zip
+// writes them by default. Like compressor, it writes nothing until its first
+// Write, since archive/zip writes the local header after making it.
+type noEOSWriter struct {
+	w    io.Writer
+	size int64
+	zw   io.WriteCloser
+}
+
+func (c *noEOSWriter) Write(p []byte) (int, error) {
+	if c.zw == nil {
+		props, _ := lzma.LevelProps(lzma.DefaultCompression)
+		if err := writePrefix(c.w, props); err != nil {
+			return 0, err
+		}
+		c.zw = lzma.NewWriterRaw(c.w, c.size, lzma.DefaultCompression, false)
+	}
+	return c.zw.Write(p)
+}
+
+func (c *noEOSWriter) Close() error {
+	return c.zw.Close()
+}
+
+// writeNoEOS returns a zip file with an LZMA entry of payload without FlagEOS.
+func writeNoEOS(t *testing.T, payload []byte) []byte {
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	zw.RegisterCompressor(Method, func(w io.Writer) (io.WriteCloser, error) {
+		return &noEOSWriter{w: w, size: int64(len(payload))}, nil
+	})
+	fw, err := zw.CreateHeader(&zip.FileHeader{Name: "noeos.txt", Method: Method})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	fw.Write(payload)
+	if err := zw.Close(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestOpen(t *testing.T) {
+	payload := readFile(t, "../data/data.txt")[:10000]
+	b := writeNoEOS(t, payload)
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	f := zr.File[0]
+	if f.Flags&FlagEOS != 0 {
+		t.Fatalf("FlagEOS set")
+	}
+	rc, err := Open(bytes.NewReader(b), f)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	res, err := ioutil.ReadAll(rc)
+	if err != nil || !bytes.Equal(res, payload) {
+		t.Errorf("got %d bytes, %v, want %d bytes", len(res), err, len(payload))
+	}
+
+	// the data is checked against the header
+	f.CRC32++
+	rc, _ = Open(bytes.NewReader(b), f)
+	if _, err = ioutil.ReadAll(rc); err != zip.ErrChecksum {
+		t.Errorf("got error %v, want %v", err, zip.ErrChecksum)
+	}
+	f.CRC32--
+	f.UncompressedSize64--
+	rc, _ = Open(bytes.NewReader(b), f)
+	if _, err = ioutil.ReadAll(rc); err == nil {
+		t.Errorf("got no error for a wrong size")
+	}
+	f.Method = zip.Deflate
+	if _, err = Open(bytes.NewReader(b), f); err != zip.ErrAlgorithm {
+		t.Errorf("got error %v, want %v", err, zip.ErrAlgorithm)
+	}
+}
+
+// Entries without FlagEOS end with their compressed data.
+func TestDecompressorNoEOS(t *testing.T) {
+	payload := []byte("lzma without end marker, lzma without end marker\n")
+	p, err := lzma.LevelProps(lzma.DefaultCompression)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	buf := new(bytes.Buffer)
+	if err := writePrefix(buf, p); err != nil {
+		t.Fatalf("%v", err)
+	}
+	w := lzma.NewWriterRaw(buf, int64(len(payload)), lzma.DefaultCompression, false)
+	w.Write(payload)
+	if err := w.Close(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	rc := Decompressor(buf)
+	defer rc.Close()
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !bytes.Equal(b, payload) {
+		t.Errorf("got %q, want %q", b, payload)
+	}
+}
+
+func TestDecompressorBadPrefix(t *testing.T) {
+	for _, tt := range []struct {
+		prefix []byte
+		err    error
+	}{
+		{[]byte{}, lzma.ErrUnexpectedEOF},
+		{[]byte{4, 65, 5, 0, 0x5d}, lzma.ErrUnexpectedEOF},
+		{[]byte{4, 65, 4, 0, 0x5d, 0, 0, 0x10, 0}, lzma.ErrHeader},
+		{[]byte{4, 65, 5, 0, 0xff, 0, 0, 0x10, 0}, lzma.ErrHeader},
+	} {
+		rc := Decompressor(bytes.NewReader(tt.prefix))
+		if _, err := ioutil.ReadAll(rc); !errors.Is(err, tt.err) {
+			t.Errorf("prefix %x: got error %v, want %v", tt.prefix, err, tt.err)
+		}
+	}
+}